@@ -28,14 +28,17 @@ func main() {
 	ctx, cancel := signal.NotifyContext(context.Background(),
 		syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 
-	a := app.New(logg, cache.NewLruImageCache(conf.LRUSize, conf.StoragePath))
+	a, err := app.New(logg, cache.NewLruImageCache(conf.LRUSize, conf.StoragePath), conf)
+	if err != nil {
+		log.Fatalf("failed to create app: %s", err)
+	}
 
 	err = a.Cache.Load()
 	if err != nil {
 		log.Fatalf("error loading cache: %s", err)
 	}
 
-	server := http.NewServer(logg, a, conf.Port)
+	server := http.NewServer(logg, a, conf.Port, conf.Compat)
 
 	defer cancel()
 
@@ -57,4 +60,7 @@ func main() {
 		cancel()
 		os.Exit(1) //nolint:gocritic
 	}
+
+	// Stops warmups and revalidation still running.
+	a.Close()
 }
@@ -0,0 +1,183 @@
+package app
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/gif"
+
+	"github.com/heltirj/image_previewer/internal/imagetransformer"
+)
+
+// transformGIF transforms every frame of a GIF source when the output is a GIF and the
+// source is animated within the frame limit. Otherwise the requested frame, the first
+// one by default, is transformed as a still image. Only the frames needed are decoded.
+func (a *App) transformGIF(data []byte, opts Options) (image.Image, error) {
+	frames, err := scanGIF(data)
+	if err != nil {
+		return nil, newError(KindUnsupportedMedia, err)
+	}
+
+	frame := 0
+	if opts.Frame != nil {
+		frame = *opts.Frame
+	}
+
+	if frame > 0 && frame >= len(frames) {
+		return nil, newError(KindBadRequest, fmt.Errorf("%w: the image has %d frames",
+			imagetransformer.ErrFrameOutOfRange, len(frames)))
+	}
+
+	if opts.Frame == nil && opts.Format == FormatGIF && len(frames) > 1 {
+		if a.withinFrameLimits(frames) {
+			g, err := gif.DecodeAll(bytes.NewReader(data))
+			if err != nil {
+				return nil, newError(KindUnsupportedMedia, err)
+			}
+
+			img, err := imagetransformer.TransformAnimation(g, opts.transformOptions(a.images))
+			if err != nil {
+				return nil, fmt.Errorf("failed to resize image: %w", err)
+			}
+
+			return img, nil
+		}
+
+		a.Logger.WarnKV("too many frames, serving the first one", "frames", len(frames),
+			"limit", a.images.MaxFrames)
+	}
+
+	// A frame is composed from all the frames before it.
+	if frame > 0 && !a.withinFrameLimits(frames[:frame+1]) {
+		return nil, newError(KindTooLarge, fmt.Errorf("frame %d is beyond the limit of %d frames",
+			frame, a.images.MaxFrames))
+	}
+
+	g, err := gif.DecodeAll(bytes.NewReader(truncateGIF(data, frames, frame+1)))
+	if err != nil {
+		return nil, newError(KindUnsupportedMedia, err)
+	}
+
+	still, err := imagetransformer.Frame(g, frame)
+	if err != nil {
+		return nil, newError(KindUnsupportedMedia, err)
+	}
+
+	img, err := imagetransformer.Transform(still, opts.transformOptions(a.images))
+	imagetransformer.Release(still)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resize image: %w", err)
+	}
+
+	return img, nil
+}
+
+// withinFrameLimits reports whether frames may be decoded: there are at most MaxFrames
+// of them and all together they have no more pixels than a source may have.
+func (a *App) withinFrameLimits(frames []gifFrame) bool {
+	if a.images.MaxFrames > 0 && len(frames) > a.images.MaxFrames {
+		return false
+	}
+
+	if a.images.MaxSourcePixels <= 0 {
+		return true
+	}
+
+	pixels := 0
+	for _, frame := range frames {
+		pixels += frame.bounds.Dx() * frame.bounds.Dy()
+	}
+
+	return pixels <= a.images.MaxSourcePixels
+}
+
+// gifFrame is an image of a GIF stream and the offset where its data ends.
+type gifFrame struct {
+	bounds image.Rectangle
+	end    int
+}
+
+var errGIFFormat = errors.New("gif: malformed stream")
+
+// scanGIF lists the frames of a GIF without decoding them, so that the limits are checked
+// before the pixels are allocated.
+func scanGIF(data []byte) ([]gifFrame, error) {
+	const (
+		headerSize     = 13
+		descriptorSize = 10
+		colorTableFlag = 0x80
+	)
+
+	if len(data) < headerSize {
+		return nil, errGIFFormat
+	}
+
+	pos := headerSize
+	if flags := data[10]; flags&colorTableFlag != 0 {
+		pos += 3 << (flags&7 + 1)
+	}
+
+	var frames []gifFrame
+	for pos < len(data) {
+		switch data[pos] {
+		case 0x21: // extension: introducer, label and data sub-blocks
+			end, err := skipSubBlocks(data, pos+2)
+			if err != nil {
+				return nil, err
+			}
+			pos = end
+		case 0x2C: // image: descriptor, local color table, LZW code size and data sub-blocks
+			if pos+descriptorSize > len(data) {
+				return nil, errGIFFormat
+			}
+
+			d := data[pos : pos+descriptorSize]
+			left, top := int(d[1])|int(d[2])<<8, int(d[3])|int(d[4])<<8
+			width, height := int(d[5])|int(d[6])<<8, int(d[7])|int(d[8])<<8
+
+			pos += descriptorSize
+			if flags := d[9]; flags&colorTableFlag != 0 {
+				pos += 3 << (flags&7 + 1)
+			}
+
+			end, err := skipSubBlocks(data, pos+1)
+			if err != nil {
+				return nil, err
+			}
+			pos = end
+
+			frames = append(frames, gifFrame{bounds: image.Rect(left, top, left+width, top+height), end: pos})
+		case 0x3B: // trailer
+			return frames, nil
+		default:
+			return nil, errGIFFormat
+		}
+	}
+
+	return frames, nil
+}
+
+// skipSubBlocks returns the offset after the data sub-blocks starting at pos.
+func skipSubBlocks(data []byte, pos int) (int, error) {
+	for {
+		if pos >= len(data) {
+			return 0, errGIFFormat
+		}
+
+		size := int(data[pos])
+		pos += size + 1
+		if size == 0 {
+			return pos, nil
+		}
+	}
+}
+
+// truncateGIF returns the GIF stream with only its first n frames.
+func truncateGIF(data []byte, frames []gifFrame, n int) []byte {
+	if n >= len(frames) {
+		return data
+	}
+
+	return append(data[:frames[n-1].end:frames[n-1].end], 0x3B)
+}
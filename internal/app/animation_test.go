@@ -0,0 +1,150 @@
+package app
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/heltirj/image_previewer/internal/config"
+	"github.com/stretchr/testify/require"
+)
+
+// encodeTestGIF encodes an animation of 40x20 frames filled with the given colors.
+func encodeTestGIF(t *testing.T, colors ...color.Color) []byte {
+	t.Helper()
+
+	palette := color.Palette(colors)
+	g := &gif.GIF{LoopCount: 2}
+	for i := range colors {
+		frame := image.NewPaletted(image.Rect(0, 0, 40, 20), palette)
+		for j := range frame.Pix {
+			frame.Pix[j] = uint8(i)
+		}
+
+		g.Image = append(g.Image, frame)
+		g.Delay = append(g.Delay, 10*(i+1))
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, gif.EncodeAll(&buf, g))
+
+	return buf.Bytes()
+}
+
+func TestAnimatedGIF(t *testing.T) {
+	red, blue, green := color.RGBA{R: 255, A: 255}, color.RGBA{B: 255, A: 255}, color.RGBA{G: 255, A: 255}
+	src := encodeTestGIF(t, red, blue, green)
+	long := encodeTestGIF(t, red, blue, green, red)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/long.gif" {
+			w.Write(long)
+			return
+		}
+		w.Write(src)
+	}))
+	defer origin.Close()
+
+	conf := config.Default()
+	conf.Image.MaxFrames = 3
+	a := newTestApp(t, conf)
+
+	t.Run("animation", func(t *testing.T) {
+		rec := doPreview(a, previewPath(20, 10, origin, "/animation.gif"))
+		require.Equal(t, http.StatusOK, rec.Code)
+		require.Equal(t, "image/gif", rec.Header().Get("Content-Type"))
+
+		g, err := gif.DecodeAll(rec.Body)
+		require.NoError(t, err)
+		require.Len(t, g.Image, 3)
+		require.Equal(t, []int{10, 20, 30}, g.Delay)
+		require.Equal(t, 2, g.LoopCount)
+		require.Equal(t, image.Rect(0, 0, 20, 10), g.Image[2].Bounds())
+		require.Equal(t, green, color.RGBAModel.Convert(g.Image[2].At(10, 5)))
+
+		rec = doPreview(a, previewPath(20, 10, origin, "/animation.gif"))
+		require.Equal(t, "HIT", rec.Header().Get(cacheStatusHeader))
+
+		g, err = gif.DecodeAll(rec.Body)
+		require.NoError(t, err)
+		require.Len(t, g.Image, 3)
+	})
+
+	t.Run("still frame", func(t *testing.T) {
+		rec := doPreview(a, previewQuery(20, 10, origin, "/animation.gif", "frame=1"))
+		require.Equal(t, http.StatusOK, rec.Code)
+
+		g, err := gif.DecodeAll(rec.Body)
+		require.NoError(t, err)
+		require.Len(t, g.Image, 1)
+		require.Equal(t, blue, color.RGBAModel.Convert(g.Image[0].At(10, 5)))
+
+		rec = doPreview(a, previewQuery(20, 10, origin, "/animation.gif", "frame=3"))
+		require.Equal(t, http.StatusBadRequest, rec.Code)
+	})
+
+	t.Run("other format", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, previewPath(20, 10, origin, "/animation.gif"), nil)
+		req.Header.Set("Accept", "image/jpeg")
+		rec := httptest.NewRecorder()
+		a.GetResizedImage(rec, req)
+		require.Equal(t, http.StatusOK, rec.Code)
+		require.Equal(t, "image/jpeg", rec.Header().Get("Content-Type"))
+
+		_, err := jpeg.Decode(rec.Body)
+		require.NoError(t, err)
+	})
+
+	t.Run("frame beyond the limit", func(t *testing.T) {
+		rec := doPreview(a, previewQuery(20, 10, origin, "/long.gif", "frame=2"))
+		require.Equal(t, http.StatusOK, rec.Code)
+
+		rec = doPreview(a, previewQuery(20, 10, origin, "/long.gif", "frame=3"))
+		require.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+	})
+
+	t.Run("too many frames", func(t *testing.T) {
+		rec := doPreview(a, previewPath(20, 10, origin, "/long.gif"))
+		require.Equal(t, http.StatusOK, rec.Code)
+
+		g, err := gif.DecodeAll(rec.Body)
+		require.NoError(t, err)
+		require.Len(t, g.Image, 1)
+		require.Equal(t, red, color.RGBAModel.Convert(g.Image[0].At(10, 5)))
+	})
+}
+
+func TestAnimatedGIFLargeScreen(t *testing.T) {
+	// A single small frame on a 65535x65535 logical screen.
+	src := encodeTestGIF(t, color.Black)
+	copy(src[6:10], []byte{0xff, 0xff, 0xff, 0xff})
+
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Write(src)
+	}))
+	defer origin.Close()
+
+	rec := doPreview(newTestApp(t, config.Default()), previewPath(20, 10, origin, "/screen.gif"))
+	require.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+}
+
+func TestScanGIF(t *testing.T) {
+	src := encodeTestGIF(t, color.Black, color.White, color.Black)
+
+	frames, err := scanGIF(src)
+	require.NoError(t, err)
+	require.Len(t, frames, 3)
+	require.Equal(t, image.Rect(0, 0, 40, 20), frames[2].bounds)
+	require.Equal(t, len(src)-1, frames[2].end)
+
+	g, err := gif.DecodeAll(bytes.NewReader(truncateGIF(src, frames, 2)))
+	require.NoError(t, err)
+	require.Len(t, g.Image, 2)
+
+	_, err = scanGIF(src[:len(src)-4])
+	require.Error(t, err)
+}
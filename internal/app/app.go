@@ -1,23 +1,37 @@
 package app
 
 import (
-	"crypto/sha256"
-	"encoding/hex"
+	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"image"
+	"image/gif"
 	"image/jpeg"
+	"image/png"
+	"io"
+	"math"
 	"net/http"
 	"net/url"
-	"regexp"
+	"runtime/debug"
 	"strconv"
+	"sync"
+	"time"
 
+	"github.com/heltirj/image_previewer/internal/config"
 	"github.com/heltirj/image_previewer/internal/imagetransformer"
 )
 
+// The size of the returned image, which may differ from the requested one.
+const (
+	imageWidthHeader  = "X-Image-Width"
+	imageHeightHeader = "X-Image-Height"
+)
+
 type Cache interface {
 	Save(key string, img image.Image) error
-	Get(key string) image.Image
+	Lookup(key string) (img image.Image, savedAt time.Time, ok bool)
 	Load() error
 	Clear() error
 }
@@ -34,170 +48,345 @@ type Logger interface {
 }
 
 type App struct {
-	Logger Logger
-	Cache  Cache
-	client *http.Client
+	Logger       Logger
+	Cache        Cache
+	client       *http.Client
+	fetch        config.FetchConfig
+	hosts        map[string]config.HostConfig
+	caching      config.CacheConfig
+	images       config.ImageConfig
+	processing   config.ProcessingConfig
+	pool         *pool
+	watermarks   map[string]*imagetransformer.Overlay
+	placeholder  *placeholder
+	breakers     *breakers
+	warmups      *warmups
+	revalidating sync.Map
+	// ctx is canceled by Close to stop the background work: warmups and revalidation.
+	ctx  context.Context
+	stop context.CancelFunc
+	wg   sync.WaitGroup
 }
 
-func New(logg Logger, cache Cache) *App {
-	return &App{
-		Logger: logg,
-		Cache:  cache,
-		client: &http.Client{},
+func New(logg Logger, cache Cache, conf *config.Config) (*App, error) {
+	placeholder, err := newPlaceholder(conf.Fallback)
+	if err != nil {
+		return nil, err
+	}
+
+	watermarks, err := loadWatermarks(conf.Watermarks)
+	if err != nil {
+		return nil, err
 	}
+
+	for host, hostConf := range conf.Hosts {
+		if _, ok := watermarks[hostConf.Watermark]; hostConf.Watermark != "" && !ok {
+			return nil, fmt.Errorf("unknown watermark of host %s: %s", host, hostConf.Watermark)
+		}
+	}
+
+	if _, ok := watermarks[conf.Image.Watermark]; conf.Image.Watermark != "" && !ok {
+		return nil, fmt.Errorf("unknown default watermark: %s", conf.Image.Watermark)
+	}
+
+	if _, err := parseHexColor(conf.Image.Background); err != nil {
+		return nil, fmt.Errorf("invalid image background: %w", err)
+	}
+
+	for name, preset := range conf.Image.Presets {
+		query, err := url.ParseQuery(preset)
+		if err == nil {
+			_, err = parseQueryOptions(query)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid preset %s: %w", name, err)
+		}
+	}
+
+	ctx, stop := context.WithCancel(context.Background())
+
+	return &App{
+		Logger:      logg,
+		Cache:       cache,
+		client:      newClient(conf.Fetch, conf.Hosts),
+		fetch:       conf.Fetch,
+		hosts:       conf.Hosts,
+		caching:     conf.Cache,
+		images:      conf.Image,
+		processing:  conf.Processing,
+		pool:        newPool(conf.Processing.Concurrency, conf.Processing.QueueSize),
+		watermarks:  watermarks,
+		placeholder: placeholder,
+		breakers:    newBreakers(logg, conf.Fetch.Breaker.FailureThreshold, conf.Fetch.Breaker.CoolDown),
+		warmups:     newWarmups(),
+		ctx:         ctx,
+		stop:        stop,
+	}, nil
 }
 
-var re = regexp.MustCompile(`^/(\d+)/(\d+)/(.*)$`)
+// Close stops the background work and waits for it to finish.
+func (a *App) Close() {
+	a.stop()
+	a.wg.Wait()
+}
+
+// logPanic logs a panic recovered in background work, which the recovery middleware of
+// the server does not cover.
+func (a *App) logPanic(recovered any, msg string, keysAndValues ...interface{}) {
+	a.Logger.ErrorKV(msg, append(keysAndValues, "panic", recovered, "stack", string(debug.Stack()))...)
+}
 
 func (a *App) GetResizedImage(w http.ResponseWriter, r *http.Request) {
-	width, height, imgURL, err := parse(r)
+	opts, err := parsePathOptions(r)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		WriteError(w, r, newError(KindBadRequest, err))
 		return
 	}
 
-	filename, err := getFileNameByURL(r.URL.RequestURI())
+	a.ServeImage(w, r, opts)
+}
+
+func (a *App) GetPreview(w http.ResponseWriter, r *http.Request) {
+	opts, err := parseQueryOptions(r.URL.Query())
 	if err != nil {
-		http.Error(w, "invalid url", http.StatusBadRequest)
+		WriteError(w, r, newError(KindBadRequest, err))
 		return
 	}
 
-	if img := a.Cache.Get(filename); img != nil {
-		returnImage(w, img)
-		return
-	}
+	a.ServeImage(w, r, opts)
+}
 
-	response, err := a.doRequest(imgURL, r)
+// ServeImage answers with the preview described by opts; it is shared by all routes.
+func (a *App) ServeImage(w http.ResponseWriter, r *http.Request, opts Options) {
+	opts, target, err := a.prepare(a.applyHints(w, r, opts))
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		WriteError(w, r, err)
 		return
 	}
-	defer response.Body.Close()
 
-	if response.StatusCode != http.StatusOK {
-		for key, value := range response.Header {
-			w.Header()[key] = value
-		}
+	if opts.DPR != 1 {
+		w.Header().Set(contentDPRHeader, strconv.FormatFloat(opts.DPR, 'f', -1, 64))
+	}
 
-		w.WriteHeader(response.StatusCode)
-		http.Error(w, "undefined source", response.StatusCode)
-		return
+	filename := opts.cacheKey(target)
+
+	cachedImg, savedAt, cached := a.Cache.Lookup(filename)
+	if cached {
+		switch a.freshness(savedAt) {
+		case entryFresh:
+			w.Header().Set(cacheStatusHeader, "HIT")
+			returnImage(w, r, cachedImg, opts.Format)
+			return
+		case entryStale:
+			a.revalidate(filename, r.Header.Clone(), target, opts)
+			markStale(w, warningStale)
+			returnImage(w, r, cachedImg, opts.Format)
+			return
+		case entryExpired:
+		}
 	}
 
-	w.Header().Set("origin", response.Request.URL.String())
-	srcImg, _, err := image.Decode(response.Body)
+	img, origin, err := a.generate(r.Context(), r.Header, target, opts, a.pool.admit)
 	if err != nil {
-		if errors.Is(err, image.ErrFormat) {
-			http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+		if cached && a.canServeStaleOnError(savedAt) {
+			a.Logger.WarnKV("serving stale image", "key", filename, "error", err)
+			markStale(w, warningRevalidationFailed)
+			returnImage(w, r, cachedImg, opts.Format)
+			return
 		}
 
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
-	}
+		if a.useFallback(opts.Fallback) {
+			a.returnFallback(w, r, err, opts)
+			return
+		}
 
-	img, err := imagetransformer.Resize(srcImg, width, height)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		if errors.Is(err, ErrOverloaded) {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(a.processing.RetryAfter.Seconds()))))
+		}
+
+		WriteError(w, r, err)
 		return
 	}
 
 	err = a.Cache.Save(filename, img)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		WriteError(w, r, err)
 		return
 	}
 
-	returnImage(w, img)
+	w.Header().Set("origin", origin)
+	w.Header().Set(cacheStatusHeader, "MISS")
+	returnImage(w, r, img, opts.Format)
 }
 
-func (a *App) ClearCache(w http.ResponseWriter, _ *http.Request) {
-	err := a.Cache.Clear()
+// prepare checks opts and resolves them against the configuration, returning the
+// options of the output image and the source URL. Its errors are bad requests.
+func (a *App) prepare(opts Options) (Options, *url.URL, error) {
+	if err := opts.validate(); err != nil {
+		return Options{}, nil, newError(KindBadRequest, err)
+	}
+
+	target, err := a.resolveSourceURL(opts.Source)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return Options{}, nil, newError(KindBadRequest, fmt.Errorf("failed to parse URL: %w", err))
 	}
 
-	w.WriteHeader(http.StatusOK)
+	opts, err = a.applyWatermark(opts, target.Hostname())
+	if err != nil {
+		return Options{}, nil, newError(KindBadRequest, err)
+	}
 
-	_, err = w.Write([]byte("cache has been cleared"))
+	opts, err = opts.resolve(a.images)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return Options{}, nil, newError(KindBadRequest, err)
 	}
+
+	return opts, target, nil
 }
 
-func (a *App) doRequest(imgURL string, r *http.Request) (*http.Response, error) {
-	parsedURL, err := url.Parse(imgURL)
+// generate downloads the source image and transforms it, returning the image and the
+// URL it was fetched from. admit takes the place of the job in the processing queue.
+func (a *App) generate(ctx context.Context, header http.Header, target *url.URL, opts Options,
+	admit func() (func(), error),
+) (image.Image, string, error) {
+	response, err := a.doRequest(ctx, target, header)
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse URL: %w", err)
+		return nil, "", err
 	}
+	defer response.Body.Close()
 
-	sendRequest := func(scheme string) (*http.Response, error) {
-		parsedURL.Scheme = scheme
-		req, err := http.NewRequestWithContext(r.Context(), r.Method, parsedURL.String(), r.Body)
-		if err != nil {
-			return nil, fmt.Errorf("failed to create request: %w", err)
-		}
-		req.Header = r.Header
-		return a.client.Do(req)
+	if response.StatusCode != http.StatusOK {
+		return nil, "", newError(upstreamErrorKind(response.StatusCode),
+			fmt.Errorf("undefined source: %s", response.Status))
 	}
 
-	resp, err := sendRequest("http")
-	if err == nil {
-		return resp, nil
+	// The source is held in memory until it is processed, so it is only downloaded once
+	// the job has a place in the queue.
+	release, err := admit()
+	if err != nil {
+		a.Logger.WarnKV("processing queue is full", "source", target.String())
+		return nil, "", err
 	}
+	defer release()
 
-	resp, err = sendRequest("https")
+	data, err := readSource(response, a.fetch.MaxSourceBytes)
 	if err != nil {
-		return nil, fmt.Errorf("failed to do request with https: %w", err)
+		return nil, "", err
 	}
 
-	return resp, nil
-}
-
-func getFileNameByURL(urlPath string) (string, error) {
-	parsedURL, err := url.Parse(urlPath)
+	source, format, err := image.DecodeConfig(bytes.NewReader(data))
 	if err != nil {
-		return "", err
+		return nil, "", newError(KindUnsupportedMedia, err)
+	}
+
+	if limit := a.images.MaxSourcePixels; limit > 0 && source.Width*source.Height > limit {
+		return nil, "", newError(KindTooLarge, fmt.Errorf("%w: %dx%d pixels", ErrSourceTooLarge,
+			source.Width, source.Height))
 	}
 
-	hash := sha256.New()
-	_, err = hash.Write([]byte(parsedURL.Path))
+	if err := checkContentType(response.Header.Get("Content-Type"), format); err != nil {
+		return nil, "", err
+	}
+
+	var img image.Image
+	start := time.Now()
+	wait, err := a.pool.work(ctx, func() error {
+		img, err = a.transformSource(data, format, opts)
+		return err
+	})
 	if err != nil {
-		return "", err
+		return nil, "", err
 	}
 
-	return hex.EncodeToString(hash.Sum(nil)) + ".jpg", nil
+	a.Logger.InfoKV("processed image", "source", target.String(), "queueWait", wait,
+		"processing", time.Since(start)-wait)
+
+	return img, response.Request.URL.String(), nil
 }
 
-func returnImage(w http.ResponseWriter, img image.Image) {
-	w.Header().Set("Content-Type", "image/jpeg")
-	err := jpeg.Encode(w, img, nil)
+// transformSource decodes the source data of the given format and transforms it. It is
+// CPU and memory heavy, so it runs in the processing pool.
+func (a *App) transformSource(data []byte, format string, opts Options) (image.Image, error) {
+	if format == "gif" {
+		return a.transformGIF(data, opts)
+	}
+
+	transformOpts := opts.transformOptions(a.images)
+
+	var srcImg image.Image
+	var err error
+	if format == "jpeg" {
+		// Large photos are decoded right at a reduced size for small previews.
+		srcImg, transformOpts, err = imagetransformer.DecodeJPEG(data, transformOpts)
+	} else {
+		srcImg, _, err = image.Decode(bytes.NewReader(data))
+	}
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, newError(KindUnsupportedMedia, err)
+	}
+
+	img, err := imagetransformer.Transform(srcImg, transformOpts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resize image: %w", err)
 	}
+
+	return img, nil
 }
 
-func parse(r *http.Request) (width, height int, imgURL string, err error) {
-	query := r.URL.RequestURI()
-	matches := re.FindStringSubmatch(query)
-	if len(matches) != 4 {
-		err = fmt.Errorf("invalid query: %s", query)
+func (a *App) ClearCache(w http.ResponseWriter, _ *http.Request) {
+	err := a.Cache.Clear()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	width, err = strconv.Atoi(matches[1])
+	w.WriteHeader(http.StatusOK)
+
+	_, err = w.Write([]byte("cache has been cleared"))
 	if err != nil {
-		err = fmt.Errorf("invalid width")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+}
 
-	height, err = strconv.Atoi(matches[2])
+func (a *App) Status(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	err := json.NewEncoder(w).Encode(struct {
+		Breakers map[string]BreakerStatus `json:"breakers"`
+	}{
+		Breakers: a.breakers.status(),
+	})
 	if err != nil {
-		err = fmt.Errorf("invalid height")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func returnImage(w http.ResponseWriter, r *http.Request, img image.Image, format Format) {
+	var buf bytes.Buffer
+	if err := encodeImage(&buf, img, format); err != nil {
+		WriteError(w, r, fmt.Errorf("failed to encode image: %w", err))
 		return
 	}
 
-	imgURL = matches[3]
-	return
+	w.Header().Set("Content-Type", format.ContentType())
+	w.Header().Set(imageWidthHeader, strconv.Itoa(img.Bounds().Dx()))
+	w.Header().Set(imageHeightHeader, strconv.Itoa(img.Bounds().Dy()))
+	w.Write(buf.Bytes())
+}
+
+func encodeImage(w io.Writer, img image.Image, format Format) error {
+	switch format {
+	case FormatPNG:
+		return png.Encode(w, img)
+	case FormatGIF:
+		if animation, ok := img.(*imagetransformer.Animation); ok {
+			return gif.EncodeAll(w, animation.GIF)
+		}
+		return gif.Encode(w, img, nil)
+	case FormatJPEG:
+		return jpeg.Encode(w, img, nil)
+	default:
+		return jpeg.Encode(w, img, nil)
+	}
 }
@@ -0,0 +1,687 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/heltirj/image_previewer/internal/cache"
+	"github.com/heltirj/image_previewer/internal/config"
+	"github.com/heltirj/image_previewer/internal/logger"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestApp(t *testing.T, conf config.Config) *App {
+	t.Helper()
+
+	a, err := New(logger.New(logger.LogLevelError), cache.NewLruImageCache(10, t.TempDir()), &conf)
+	require.NoError(t, err)
+
+	return a
+}
+
+func encodeTestJPEG(t *testing.T, width, height int) []byte {
+	t.Helper()
+
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for x := 0; x < width; x++ {
+		for y := 0; y < height; y++ {
+			img.Set(x, y, color.RGBA{uint8(x), uint8(y), 255, 255})
+		}
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, jpeg.Encode(&buf, img, nil))
+
+	return buf.Bytes()
+}
+
+func previewPath(width, height int, origin *httptest.Server, path string) string {
+	return "/" + strconv.Itoa(width) + "/" + strconv.Itoa(height) + "/" + origin.URL + path
+}
+
+// previewQuery builds a /preview request for the source at path with extra params.
+func previewQuery(width, height int, origin *httptest.Server, path, params string) string {
+	query := "/preview?w=" + strconv.Itoa(width) + "&h=" + strconv.Itoa(height) + "&url=" + origin.URL + path
+	if params != "" {
+		query += "&" + params
+	}
+
+	return query
+}
+
+func doPreview(a *App, path string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	if strings.HasPrefix(path, "/preview") {
+		a.GetPreview(rec, req)
+	} else {
+		a.GetResizedImage(rec, req)
+	}
+
+	return rec
+}
+
+func TestGetResizedImage(t *testing.T) {
+	src := encodeTestJPEG(t, 200, 100)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Write(src)
+	}))
+	defer origin.Close()
+
+	a := newTestApp(t, config.Default())
+
+	rec := doPreview(a, previewPath(50, 50, origin, "/img.jpg"))
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	require.Equal(t, "image/jpeg", rec.Header().Get("Content-Type"))
+
+	img, err := jpeg.Decode(rec.Body)
+	require.NoError(t, err)
+	require.Equal(t, image.Rect(0, 0, 50, 50), img.Bounds())
+}
+
+func TestGetResizedImageSizeLimit(t *testing.T) {
+	src := encodeTestJPEG(t, 10, 2000)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Write(src)
+	}))
+	defer origin.Close()
+
+	a := newTestApp(t, config.Default())
+
+	// The height computed from the aspect ratio would be 819200 pixels.
+	rec := doPreview(a, previewPath(4096, 0, origin, "/tall.jpg"))
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	img, err := jpeg.Decode(rec.Body)
+	require.NoError(t, err)
+	require.Equal(t, image.Rect(0, 0, 20, 4096), img.Bounds())
+}
+
+func TestGetResizedImageTimeouts(t *testing.T) {
+	src := encodeTestJPEG(t, 200, 100)
+	release := make(chan struct{})
+	defer close(release)
+
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow-body.jpg" {
+			w.Header().Set("Content-Length", strconv.Itoa(len(src)))
+			w.Write(src[:10])
+			w.(http.Flusher).Flush()
+		}
+
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer origin.Close()
+
+	t.Run("slow headers", func(t *testing.T) {
+		conf := config.Default()
+		conf.Fetch.HeaderTimeout = time.Millisecond * 50
+
+		rec := doPreview(newTestApp(t, conf), previewPath(50, 50, origin, "/slow-headers.jpg"))
+		require.Equal(t, http.StatusGatewayTimeout, rec.Code)
+	})
+
+	t.Run("slow body", func(t *testing.T) {
+		conf := config.Default()
+		conf.Fetch.Timeout = time.Millisecond * 100
+
+		rec := doPreview(newTestApp(t, conf), previewPath(50, 50, origin, "/slow-body.jpg"))
+		require.Equal(t, http.StatusGatewayTimeout, rec.Code)
+	})
+}
+
+func TestGetResizedImageTooLarge(t *testing.T) {
+	huge := bytes.Repeat([]byte{0xff}, 1<<20)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/declared.jpg" {
+			w.Header().Set("Content-Length", strconv.Itoa(len(huge)))
+		}
+		w.Write(huge)
+	}))
+	defer origin.Close()
+
+	conf := config.Default()
+	conf.Fetch.MaxSourceBytes = 1024
+	a := newTestApp(t, conf)
+
+	for _, path := range []string{"/declared.jpg", "/chunked.jpg"} {
+		rec := doPreview(a, previewPath(50, 50, origin, path))
+		require.Equal(t, http.StatusRequestEntityTooLarge, rec.Code, path)
+	}
+}
+
+func TestGetResizedImageUpstreamRequest(t *testing.T) {
+	src := encodeTestJPEG(t, 200, 100)
+	upstream := make(chan *http.Request, 1)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstream <- r
+		w.Write(src)
+	}))
+	defer origin.Close()
+
+	conf := config.Default()
+	conf.Fetch.ForwardHeaders = []string{"accept-language", "Cookie", "Authorization"}
+	conf.Fetch.UserAgent = "previewer-test"
+	conf.Hosts = map[string]config.HostConfig{
+		"127.0.0.1": {
+			Scheme:    "http",
+			Headers:   map[string]string{"X-Api-Key": "secret"},
+			BasicAuth: &config.BasicAuth{Username: "user", Password: "pass"},
+		},
+	}
+	a := newTestApp(t, conf)
+
+	req := httptest.NewRequest(http.MethodPost, previewPath(50, 50, origin, "/img.jpg"),
+		strings.NewReader("client body"))
+	req.Header.Set("Accept-Language", "ru-RU")
+	req.Header.Set("User-Agent", "client-agent")
+	req.Header.Set("Cookie", "session=123")
+	req.Header.Set("Authorization", "Bearer client-token")
+	req.Header.Set("X-Forwarded-For", "10.0.0.1")
+
+	rec := httptest.NewRecorder()
+	a.GetResizedImage(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	got := <-upstream
+	require.Equal(t, http.MethodGet, got.Method)
+	require.Zero(t, got.ContentLength)
+	require.Equal(t, "ru-RU", got.Header.Get("Accept-Language"))
+	require.Equal(t, "previewer-test", got.Header.Get("User-Agent"))
+	require.Equal(t, "secret", got.Header.Get("X-Api-Key"))
+	require.Empty(t, got.Header.Get("Cookie"))
+	require.Empty(t, got.Header.Get("X-Forwarded-For"))
+
+	username, password, ok := got.BasicAuth()
+	require.True(t, ok)
+	require.Equal(t, "user", username)
+	require.Equal(t, "pass", password)
+}
+
+func TestGetResizedImageRedirectHeaders(t *testing.T) {
+	src := encodeTestJPEG(t, 200, 100)
+	upstream := make(chan *http.Request, 1)
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstream <- r
+		w.Write(src)
+	}))
+	defer other.Close()
+
+	// The redirect leads to another host name of the same machine.
+	otherURL := strings.Replace(other.URL, "127.0.0.1", "localhost", 1)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, otherURL+"/img.jpg", http.StatusFound)
+	}))
+	defer origin.Close()
+
+	conf := config.Default()
+	conf.Hosts = map[string]config.HostConfig{
+		"127.0.0.1": {
+			Scheme:    "http",
+			Headers:   map[string]string{"X-Api-Key": "secret"},
+			BasicAuth: &config.BasicAuth{Username: "user", Password: "pass"},
+		},
+		"localhost": {Scheme: "http", Headers: map[string]string{"X-Other-Key": "other"}},
+	}
+	a := newTestApp(t, conf)
+
+	rec := doPreview(a, previewPath(50, 50, origin, "/img.jpg"))
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	got := <-upstream
+	require.Empty(t, got.Header.Get("X-Api-Key"))
+	require.Empty(t, got.Header.Get("Authorization"))
+	require.Equal(t, "other", got.Header.Get("X-Other-Key"))
+}
+
+func TestGetResizedImageInsecureRedirect(t *testing.T) {
+	src := encodeTestJPEG(t, 200, 100)
+	plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Write(src)
+	}))
+	defer plain.Close()
+
+	secure := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, plain.URL+"/img.jpg", http.StatusFound)
+	}))
+	defer secure.Close()
+
+	setup := func(t *testing.T, conf config.Config) *App {
+		t.Helper()
+
+		a := newTestApp(t, conf)
+		a.client.Transport.(*http.Transport).TLSClientConfig = secure.Client().Transport.(*http.Transport).TLSClientConfig
+
+		return a
+	}
+
+	t.Run("refused", func(t *testing.T) {
+		a := setup(t, config.Default())
+
+		rec := doPreview(a, previewPath(50, 50, secure, "/img.jpg"))
+		require.Equal(t, http.StatusBadGateway, rec.Code)
+		require.Contains(t, rec.Body.String(), ErrInsecureRedirect.Error())
+		require.Empty(t, a.breakers.status())
+	})
+
+	t.Run("allowed for http hosts", func(t *testing.T) {
+		conf := config.Default()
+		conf.Hosts = map[string]config.HostConfig{"127.0.0.1": {Scheme: "http"}}
+		a := setup(t, conf)
+
+		rec := doPreview(a, previewPath(50, 50, secure, "/img.jpg"))
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+		require.Equal(t, plain.URL+"/img.jpg", rec.Header().Get("origin"))
+	})
+}
+
+func TestGetResizedImageScheme(t *testing.T) {
+	src := encodeTestJPEG(t, 200, 100)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Write(src)
+	}))
+	defer origin.Close()
+
+	host := strings.TrimPrefix(origin.URL, "http://")
+
+	t.Run("explicit scheme", func(t *testing.T) {
+		a := newTestApp(t, config.Default())
+
+		for _, path := range []string{"/50/50/http://" + host + "/a.jpg", "/50/50/http:/" + host + "/b.jpg"} {
+			rec := doPreview(a, path)
+			require.Equal(t, http.StatusOK, rec.Code, path)
+			require.True(t, strings.HasPrefix(rec.Header().Get("origin"), "http://"+host+"/"))
+		}
+	})
+
+	t.Run("https by default", func(t *testing.T) {
+		a := newTestApp(t, config.Default())
+
+		rec := doPreview(a, "/50/50/"+host+"/img.jpg")
+		require.NotEqual(t, http.StatusOK, rec.Code)
+		require.Empty(t, rec.Header().Get("origin"))
+	})
+
+	t.Run("host scheme from config", func(t *testing.T) {
+		conf := config.Default()
+		conf.Hosts = map[string]config.HostConfig{"127.0.0.1": {Scheme: "http"}}
+		a := newTestApp(t, conf)
+
+		rec := doPreview(a, "/50/50/"+host+"/img.jpg")
+		require.Equal(t, http.StatusOK, rec.Code)
+		require.Equal(t, origin.URL+"/img.jpg", rec.Header().Get("origin"))
+	})
+
+	t.Run("credentials over http", func(t *testing.T) {
+		var requests atomic.Int32
+		origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			requests.Add(1)
+			w.Write(src)
+		}))
+		defer origin.Close()
+
+		host := strings.TrimPrefix(origin.URL, "http://")
+		auth := &config.BasicAuth{Username: "u", Password: "p"}
+
+		for _, hostConf := range []config.HostConfig{
+			{Scheme: "https", BasicAuth: auth},
+			{BasicAuth: auth},
+			{Headers: map[string]string{"X-Api-Key": "secret"}},
+		} {
+			conf := config.Default()
+			conf.Fetch.DefaultScheme = "http"
+			conf.Hosts = map[string]config.HostConfig{"127.0.0.1": hostConf}
+			a := newTestApp(t, conf)
+
+			paths := []string{"/50/50/http://" + host + "/img.jpg"}
+			if hostConf.Scheme == "" {
+				// The default scheme is http.
+				paths = append(paths, "/50/50/"+host+"/img.jpg")
+			}
+
+			for _, path := range paths {
+				rec := doPreview(a, path)
+				require.Equal(t, http.StatusBadRequest, rec.Code, path)
+			}
+		}
+		require.Zero(t, requests.Load())
+	})
+
+	t.Run("unsupported scheme", func(t *testing.T) {
+		conf := config.Default()
+		conf.Fetch.DefaultScheme = "ftp"
+		a := newTestApp(t, conf)
+
+		rec := doPreview(a, "/50/50/"+host+"/img.jpg")
+		require.NotEqual(t, http.StatusOK, rec.Code)
+	})
+}
+
+func TestGetResizedImageRetries(t *testing.T) {
+	src := encodeTestJPEG(t, 200, 100)
+	var calls atomic.Int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := calls.Add(1)
+		switch {
+		case r.URL.Path == "/flaky.jpg" && n <= 2:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case r.URL.Path == "/broken.jpg":
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			w.Write(src)
+		}
+	}))
+	defer origin.Close()
+
+	conf := config.Default()
+	conf.Fetch.Retry = config.RetryConfig{Attempts: 2, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+
+	t.Run("transient errors are retried", func(t *testing.T) {
+		calls.Store(0)
+		rec := doPreview(newTestApp(t, conf), previewPath(50, 50, origin, "/flaky.jpg"))
+		require.Equal(t, http.StatusOK, rec.Code)
+		require.Equal(t, int32(3), calls.Load())
+	})
+
+	t.Run("other errors are not retried", func(t *testing.T) {
+		calls.Store(0)
+		rec := doPreview(newTestApp(t, conf), previewPath(50, 50, origin, "/broken.jpg"))
+		require.Equal(t, http.StatusBadGateway, rec.Code)
+		require.Equal(t, int32(1), calls.Load())
+	})
+}
+
+func TestGetResizedImageCircuitBreaker(t *testing.T) {
+	var calls atomic.Int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer origin.Close()
+
+	conf := config.Default()
+	conf.Fetch.Retry.Attempts = 0
+	conf.Fetch.Breaker = config.BreakerConfig{FailureThreshold: 2, CoolDown: time.Minute}
+	a := newTestApp(t, conf)
+
+	for i := 0; i < 2; i++ {
+		rec := doPreview(a, previewPath(50, 50, origin, "/img.jpg"))
+		require.Equal(t, http.StatusBadGateway, rec.Code)
+	}
+
+	rec := doPreview(a, previewPath(50, 50, origin, "/img.jpg"))
+	require.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	require.Equal(t, int32(2), calls.Load())
+
+	rec = httptest.NewRecorder()
+	a.Status(rec, httptest.NewRequest(http.MethodGet, "/status", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var status struct {
+		Breakers map[string]BreakerStatus `json:"breakers"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &status))
+
+	host := strings.TrimPrefix(origin.URL, "http://")
+	require.Equal(t, "open", status.Breakers[host].State)
+	require.Equal(t, 2, status.Breakers[host].Failures)
+}
+
+func TestGetResizedImageCanceledClients(t *testing.T) {
+	src := encodeTestJPEG(t, 200, 100)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Write(src)
+	}))
+	defer origin.Close()
+
+	conf := config.Default()
+	conf.Fetch.Breaker = config.BreakerConfig{FailureThreshold: 2, CoolDown: time.Minute}
+	a := newTestApp(t, conf)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for i := 0; i < 3; i++ {
+		req := httptest.NewRequest(http.MethodGet, previewPath(50, 50, origin, "/img.jpg"), nil).WithContext(ctx)
+		a.GetResizedImage(httptest.NewRecorder(), req)
+	}
+	require.Empty(t, a.breakers.status())
+
+	rec := doPreview(a, previewPath(50, 50, origin, "/img.jpg"))
+	require.Equal(t, http.StatusOK, rec.Code)
+}
+
+func TestGetResizedImageStale(t *testing.T) {
+	src := encodeTestJPEG(t, 200, 100)
+	var calls atomic.Int32
+	var failing atomic.Bool
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		calls.Add(1)
+		if failing.Load() {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(src)
+	}))
+	defer origin.Close()
+
+	path := previewPath(50, 50, origin, "/img.jpg")
+	setup := func(t *testing.T, caching config.CacheConfig) *App {
+		t.Helper()
+
+		calls.Store(0)
+		failing.Store(false)
+
+		conf := config.Default()
+		conf.Cache = caching
+		a := newTestApp(t, conf)
+
+		rec := doPreview(a, path)
+		require.Equal(t, http.StatusOK, rec.Code)
+		require.Equal(t, "MISS", rec.Header().Get(cacheStatusHeader))
+		time.Sleep(time.Millisecond * 5)
+
+		return a
+	}
+
+	t.Run("fresh", func(t *testing.T) {
+		a := setup(t, config.CacheConfig{TTL: time.Hour})
+
+		rec := doPreview(a, path)
+		require.Equal(t, http.StatusOK, rec.Code)
+		require.Equal(t, "HIT", rec.Header().Get(cacheStatusHeader))
+		require.Empty(t, rec.Header().Get("Warning"))
+		require.Equal(t, int32(1), calls.Load())
+	})
+
+	t.Run("stale while revalidate", func(t *testing.T) {
+		a := setup(t, config.CacheConfig{TTL: time.Millisecond, StaleWhileRevalidate: time.Hour})
+
+		rec := doPreview(a, path)
+		require.Equal(t, http.StatusOK, rec.Code)
+		require.Equal(t, "STALE", rec.Header().Get(cacheStatusHeader))
+		require.Equal(t, warningStale, rec.Header().Get("Warning"))
+
+		a.wg.Wait()
+		require.Equal(t, int32(2), calls.Load())
+
+		_, savedAt, ok := a.Cache.Lookup(mustCacheKey(t, a, path))
+		require.True(t, ok)
+		require.WithinDuration(t, time.Now(), savedAt, time.Second)
+	})
+
+	t.Run("stale if error", func(t *testing.T) {
+		a := setup(t, config.CacheConfig{TTL: time.Millisecond, StaleIfError: time.Hour})
+		failing.Store(true)
+
+		rec := doPreview(a, path)
+		require.Equal(t, http.StatusOK, rec.Code)
+		require.Equal(t, "STALE", rec.Header().Get(cacheStatusHeader))
+		require.Equal(t, warningRevalidationFailed, rec.Header().Get("Warning"))
+		require.Equal(t, int32(2), calls.Load())
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		a := setup(t, config.CacheConfig{TTL: time.Millisecond})
+		failing.Store(true)
+
+		rec := doPreview(a, path)
+		require.Equal(t, http.StatusNotFound, rec.Code)
+		require.Empty(t, rec.Header().Get("Warning"))
+	})
+}
+
+func mustCacheKey(t *testing.T, a *App, path string) string {
+	t.Helper()
+
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	opts, err := parsePathOptions(req)
+	require.NoError(t, err)
+
+	opts, err = a.applyHints(httptest.NewRecorder(), req, opts).resolve(a.images)
+	require.NoError(t, err)
+
+	target, err := a.resolveSourceURL(opts.Source)
+	require.NoError(t, err)
+
+	return opts.cacheKey(target)
+}
+
+func TestGetResizedImageErrors(t *testing.T) {
+	src := encodeTestJPEG(t, 200, 100)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/missing.jpg":
+			http.NotFound(w, r)
+		case "/gone.jpg":
+			w.WriteHeader(http.StatusGone)
+		case "/private.jpg":
+			w.WriteHeader(http.StatusForbidden)
+		case "/unauthorized.jpg":
+			w.WriteHeader(http.StatusUnauthorized)
+		case "/error.jpg":
+			w.WriteHeader(http.StatusInternalServerError)
+		case "/text.txt":
+			w.Write([]byte("definitely not an image"))
+		case "/corrupt.jpg":
+			w.Write(src[:len(src)/2])
+		default:
+			w.Write(src)
+		}
+	}))
+	defer origin.Close()
+
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	tests := []struct {
+		name           string
+		path           string
+		expectedStatus int
+	}{
+		{"invalid route", "/abc/50/" + origin.URL + "/img.jpg", http.StatusBadRequest},
+		{"empty source host", "/50/50/", http.StatusBadRequest},
+		{"not found", previewPath(50, 50, origin, "/missing.jpg"), http.StatusNotFound},
+		{"gone", previewPath(50, 50, origin, "/gone.jpg"), http.StatusNotFound},
+		{"forbidden", previewPath(50, 50, origin, "/private.jpg"), http.StatusForbidden},
+		{"unauthorized", previewPath(50, 50, origin, "/unauthorized.jpg"), http.StatusForbidden},
+		{"upstream error", previewPath(50, 50, origin, "/error.jpg"), http.StatusBadGateway},
+		{"upstream unreachable", previewPath(50, 50, closed, "/img.jpg"), http.StatusBadGateway},
+		{"not an image", previewPath(50, 50, origin, "/text.txt"), http.StatusUnsupportedMediaType},
+		{"corrupt image", previewPath(50, 50, origin, "/corrupt.jpg"), http.StatusUnsupportedMediaType},
+	}
+
+	conf := config.Default()
+	conf.Fetch.Retry.Attempts = 0
+	a := newTestApp(t, conf)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := doPreview(a, tt.path)
+			require.Equal(t, tt.expectedStatus, rec.Code)
+			require.Equal(t, "text/plain; charset=utf-8", rec.Header().Get("Content-Type"))
+			require.Equal(t, 1, strings.Count(rec.Body.String(), "\n"), "error body must be written once")
+		})
+	}
+
+	t.Run("cache failure", func(t *testing.T) {
+		dir := t.TempDir()
+		a, err := New(logger.New(logger.LogLevelError), cache.NewLruImageCache(10, dir), &conf)
+		require.NoError(t, err)
+		require.NoError(t, os.RemoveAll(dir))
+
+		rec := doPreview(a, previewPath(50, 50, origin, "/img.jpg"))
+		require.Equal(t, http.StatusInternalServerError, rec.Code)
+		require.Equal(t, 1, strings.Count(rec.Body.String(), "\n"))
+	})
+}
+
+func TestErrorKindStatus(t *testing.T) {
+	require.Equal(t, http.StatusInternalServerError, errorKind(errors.New("plain")).Status())
+	require.Equal(t, http.StatusNotFound,
+		errorKind(fmt.Errorf("wrapped: %w", newError(KindNotFound, errors.New("missing")))).Status())
+	require.Equal(t, http.StatusGatewayTimeout, errorKind(newError(KindTimeout, errors.New("slow"))).Status())
+}
+
+func TestGetResizedImageJSONErrors(t *testing.T) {
+	origin := httptest.NewServer(http.NotFoundHandler())
+	defer origin.Close()
+
+	a := newTestApp(t, config.Default())
+	path := previewPath(50, 50, origin, "/missing.jpg")
+
+	tests := []struct {
+		accept   string
+		wantJSON bool
+	}{
+		{"application/json", true},
+		{"text/plain;q=0.5, application/json", true},
+		{"", false},
+		{"*/*", false},
+		{"image/avif,image/webp,image/*,*/*;q=0.8", false},
+		{"application/json;q=0", false},
+		{"application/json;q=0.5, text/plain", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.accept, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, path, nil)
+			req.Header.Set("Accept", tt.accept)
+			req.Header.Set(RequestIDHeader, "req-1")
+
+			rec := httptest.NewRecorder()
+			a.GetResizedImage(rec, req)
+			require.Equal(t, http.StatusNotFound, rec.Code)
+
+			if !tt.wantJSON {
+				require.Equal(t, "text/plain; charset=utf-8", rec.Header().Get("Content-Type"))
+				return
+			}
+
+			require.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+
+			var body errorResponse
+			require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+			require.Equal(t, CodeSourceNotFound, body.Code)
+			require.Equal(t, "req-1", body.RequestID)
+			require.NotEmpty(t, body.Message)
+		})
+	}
+}
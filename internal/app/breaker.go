@@ -0,0 +1,178 @@
+package app
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var ErrCircuitOpen = errors.New("circuit breaker is open for source host")
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerClosed:
+		return "closed"
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+type BreakerStatus struct {
+	State    string     `json:"state"`
+	Failures int        `json:"failures"`
+	OpenedAt *time.Time `json:"openedAt,omitempty"`
+}
+
+type hostBreaker struct {
+	state    breakerState
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+// breakers keeps a circuit breaker per origin host. After threshold consecutive
+// failures the host is rejected for coolDown, then a single probe request decides
+// whether the breaker closes again.
+type breakers struct {
+	m         sync.Mutex
+	threshold int
+	coolDown  time.Duration
+	hosts     map[string]*hostBreaker
+	logger    Logger
+	now       func() time.Time
+}
+
+func newBreakers(logg Logger, threshold int, coolDown time.Duration) *breakers {
+	return &breakers{
+		threshold: threshold,
+		coolDown:  coolDown,
+		hosts:     make(map[string]*hostBreaker),
+		logger:    logg,
+		now:       time.Now,
+	}
+}
+
+func (b *breakers) allow(host string) error {
+	if b.threshold <= 0 {
+		return nil
+	}
+
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	hb, ok := b.hosts[host]
+	if !ok {
+		return nil
+	}
+
+	switch hb.state {
+	case breakerOpen:
+		if b.now().Sub(hb.openedAt) < b.coolDown {
+			return ErrCircuitOpen
+		}
+
+		hb.state = breakerHalfOpen
+		hb.probing = true
+		b.logger.InfoKV("circuit breaker half-open", "host", host)
+		return nil
+	case breakerHalfOpen:
+		if hb.probing {
+			return ErrCircuitOpen
+		}
+
+		hb.probing = true
+		return nil
+	case breakerClosed:
+	}
+
+	return nil
+}
+
+func (b *breakers) success(host string) {
+	if b.threshold <= 0 {
+		return
+	}
+
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	hb, ok := b.hosts[host]
+	if !ok {
+		return
+	}
+
+	if hb.state != breakerClosed {
+		b.logger.InfoKV("circuit breaker closed", "host", host)
+	}
+
+	delete(b.hosts, host)
+}
+
+// release ends a request that neither succeeded nor failed, letting another request
+// probe a half-open host.
+func (b *breakers) release(host string) {
+	if b.threshold <= 0 {
+		return
+	}
+
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	if hb, ok := b.hosts[host]; ok {
+		hb.probing = false
+	}
+}
+
+func (b *breakers) failure(host string) {
+	if b.threshold <= 0 {
+		return
+	}
+
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	hb, ok := b.hosts[host]
+	if !ok {
+		hb = &hostBreaker{}
+		b.hosts[host] = hb
+	}
+
+	hb.failures++
+	hb.probing = false
+
+	if hb.state == breakerHalfOpen || (hb.state == breakerClosed && hb.failures >= b.threshold) {
+		hb.state = breakerOpen
+		hb.openedAt = b.now()
+		b.logger.WarnKV("circuit breaker opened", "host", host, "failures", hb.failures,
+			"coolDown", b.coolDown)
+	}
+}
+
+func (b *breakers) status() map[string]BreakerStatus {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	status := make(map[string]BreakerStatus, len(b.hosts))
+	for host, hb := range b.hosts {
+		hostStatus := BreakerStatus{State: hb.state.String(), Failures: hb.failures}
+		if !hb.openedAt.IsZero() {
+			openedAt := hb.openedAt
+			hostStatus.OpenedAt = &openedAt
+		}
+		status[host] = hostStatus
+	}
+
+	return status
+}
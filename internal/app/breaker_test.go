@@ -0,0 +1,66 @@
+package app
+
+import (
+	"testing"
+	"time"
+
+	"github.com/heltirj/image_previewer/internal/logger"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBreakers(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	b := newBreakers(logger.New(logger.LogLevelError), 2, time.Minute)
+	b.now = func() time.Time { return now }
+
+	require.NoError(t, b.allow("example.com"))
+	b.failure("example.com")
+	require.NoError(t, b.allow("example.com"))
+	require.Equal(t, "closed", b.status()["example.com"].State)
+
+	b.failure("example.com")
+	require.ErrorIs(t, b.allow("example.com"), ErrCircuitOpen)
+	require.NoError(t, b.allow("other.com"))
+	require.Equal(t, "open", b.status()["example.com"].State)
+	require.Equal(t, now, *b.status()["example.com"].OpenedAt)
+
+	now = now.Add(time.Minute)
+	require.NoError(t, b.allow("example.com"))
+	require.ErrorIs(t, b.allow("example.com"), ErrCircuitOpen, "only one probe is allowed while half-open")
+	require.Equal(t, "half-open", b.status()["example.com"].State)
+
+	b.failure("example.com")
+	require.ErrorIs(t, b.allow("example.com"), ErrCircuitOpen)
+
+	now = now.Add(time.Minute)
+	require.NoError(t, b.allow("example.com"))
+	b.success("example.com")
+	require.NoError(t, b.allow("example.com"))
+	require.NotContains(t, b.status(), "example.com")
+}
+
+func TestBreakersRelease(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	b := newBreakers(logger.New(logger.LogLevelError), 1, time.Minute)
+	b.now = func() time.Time { return now }
+
+	b.failure("example.com")
+	now = now.Add(time.Minute)
+	require.NoError(t, b.allow("example.com"))
+
+	// A canceled probe lets the next request probe instead of keeping the host half-open.
+	b.release("example.com")
+	require.NoError(t, b.allow("example.com"))
+	require.Equal(t, "half-open", b.status()["example.com"].State)
+}
+
+func TestBreakersDisabled(t *testing.T) {
+	b := newBreakers(logger.New(logger.LogLevelError), 0, time.Minute)
+
+	for i := 0; i < 10; i++ {
+		b.failure("example.com")
+	}
+
+	require.NoError(t, b.allow("example.com"))
+	require.Empty(t, b.status())
+}
@@ -0,0 +1,165 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+)
+
+const RequestIDHeader = "X-Request-Id"
+
+// Error codes returned in JSON error responses. They are part of the public API
+// and must not change.
+const (
+	CodeBadRequest        = "BAD_REQUEST"
+	CodeSourceNotFound    = "SOURCE_NOT_FOUND"
+	CodeSourceForbidden   = "SOURCE_FORBIDDEN"
+	CodeUnsupportedMedia  = "UNSUPPORTED_MEDIA_TYPE"
+	CodeSourceTooLarge    = "SOURCE_TOO_LARGE"
+	CodeUpstreamFailure   = "UPSTREAM_FAILURE"
+	CodeUpstreamTimeout   = "UPSTREAM_TIMEOUT"
+	CodeSourceUnavailable = "SOURCE_UNAVAILABLE"
+	CodeOverloaded        = "OVERLOADED"
+	CodeInternal          = "INTERNAL_ERROR"
+)
+
+type ErrorKind int
+
+const (
+	KindInternal ErrorKind = iota
+	KindBadRequest
+	KindNotFound
+	KindForbidden
+	KindUnsupportedMedia
+	KindTooLarge
+	KindUpstreamFailure
+	KindTimeout
+	KindUnavailable
+	KindOverloaded
+)
+
+// Error is a failure of the preview pipeline classified by its kind; the kind alone
+// decides how the failure is reported to the client.
+type Error struct {
+	Kind ErrorKind
+	Err  error
+}
+
+func newError(kind ErrorKind, err error) *Error {
+	return &Error{Kind: kind, Err: err}
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func (k ErrorKind) Status() int {
+	switch k {
+	case KindBadRequest:
+		return http.StatusBadRequest
+	case KindNotFound:
+		return http.StatusNotFound
+	case KindForbidden:
+		return http.StatusForbidden
+	case KindUnsupportedMedia:
+		return http.StatusUnsupportedMediaType
+	case KindTooLarge:
+		return http.StatusRequestEntityTooLarge
+	case KindUpstreamFailure:
+		return http.StatusBadGateway
+	case KindTimeout:
+		return http.StatusGatewayTimeout
+	case KindUnavailable, KindOverloaded:
+		return http.StatusServiceUnavailable
+	case KindInternal:
+		return http.StatusInternalServerError
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func (k ErrorKind) Code() string {
+	switch k {
+	case KindBadRequest:
+		return CodeBadRequest
+	case KindNotFound:
+		return CodeSourceNotFound
+	case KindForbidden:
+		return CodeSourceForbidden
+	case KindUnsupportedMedia:
+		return CodeUnsupportedMedia
+	case KindTooLarge:
+		return CodeSourceTooLarge
+	case KindUpstreamFailure:
+		return CodeUpstreamFailure
+	case KindTimeout:
+		return CodeUpstreamTimeout
+	case KindUnavailable:
+		return CodeSourceUnavailable
+	case KindOverloaded:
+		return CodeOverloaded
+	case KindInternal:
+		return CodeInternal
+	default:
+		return CodeInternal
+	}
+}
+
+// errorKind returns the kind of err, treating unclassified errors as internal.
+func errorKind(err error) ErrorKind {
+	var appErr *Error
+	if errors.As(err, &appErr) {
+		return appErr.Kind
+	}
+
+	return KindInternal
+}
+
+// upstreamErrorKind classifies a non-200 response of the origin.
+func upstreamErrorKind(status int) ErrorKind {
+	switch status {
+	case http.StatusNotFound, http.StatusGone:
+		return KindNotFound
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return KindForbidden
+	case http.StatusRequestEntityTooLarge:
+		return KindTooLarge
+	default:
+		return KindUpstreamFailure
+	}
+}
+
+type errorResponse struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	RequestID string `json:"requestId,omitempty"`
+}
+
+// WriteError answers with a JSON payload to clients that explicitly accept JSON
+// and with a plain text message to everyone else.
+func WriteError(w http.ResponseWriter, r *http.Request, err error) {
+	kind := errorKind(err)
+	if !acceptsJSON(r) {
+		http.Error(w, err.Error(), kind.Status())
+		return
+	}
+
+	body, marshalErr := json.Marshal(errorResponse{
+		Code:      kind.Code(),
+		Message:   err.Error(),
+		RequestID: r.Header.Get(RequestIDHeader),
+	})
+	if marshalErr != nil {
+		http.Error(w, err.Error(), kind.Status())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(kind.Status())
+	w.Write(append(body, '\n'))
+}
@@ -0,0 +1,130 @@
+package app
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/heltirj/image_previewer/internal/config"
+	"github.com/heltirj/image_previewer/internal/imagetransformer"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+const (
+	fallbackParam        = "fallback"
+	fallbackStatusHeader = "X-Fallback-Status"
+)
+
+// placeholder is the image served instead of an error when fallback mode is on.
+type placeholder struct {
+	enabled bool
+	image   image.Image
+	color   color.RGBA
+}
+
+func newPlaceholder(conf config.FallbackConfig) (*placeholder, error) {
+	bg, err := parseHexColor(conf.Color)
+	if err != nil {
+		return nil, fmt.Errorf("invalid fallback color: %w", err)
+	}
+
+	p := &placeholder{enabled: conf.Enabled, color: bg}
+	if conf.Image == "" {
+		return p, nil
+	}
+
+	file, err := os.Open(conf.Image)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open fallback image: %w", err)
+	}
+	defer file.Close()
+
+	p.image, _, err = image.Decode(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode fallback image: %w", err)
+	}
+
+	return p, nil
+}
+
+// render returns the placeholder of the requested size: the configured image resized
+// to fit or a solid color with the status text. A solid placeholder with one side
+// omitted is square.
+func (p *placeholder) render(width, height, status int) (image.Image, error) {
+	if p.image != nil {
+		return imagetransformer.Resize(p.image, width, height)
+	}
+
+	if width == 0 {
+		width = height
+	} else if height == 0 {
+		height = width
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(img, img.Bounds(), &image.Uniform{C: p.color}, image.Point{}, draw.Src)
+
+	text := strconv.Itoa(status) + " " + http.StatusText(status)
+	face := basicfont.Face7x13
+	drawer := &font.Drawer{Dst: img, Src: image.NewUniform(contrastColor(p.color)), Face: face}
+	textWidth := drawer.MeasureString(text).Round()
+	drawer.Dot = fixed.P((width-textWidth)/2, (height+face.Ascent-face.Descent)/2)
+	drawer.DrawString(text)
+
+	return img, nil
+}
+
+func (a *App) useFallback(requested *bool) bool {
+	if requested != nil {
+		return *requested
+	}
+
+	return a.placeholder.enabled
+}
+
+// returnFallback answers with the placeholder and the real status in a header, so that
+// <img> tags render something instead of a broken image icon.
+func (a *App) returnFallback(w http.ResponseWriter, r *http.Request, cause error, opts Options) {
+	status := errorKind(cause).Status()
+
+	img, err := a.placeholder.render(opts.Width, opts.Height, status)
+	if err != nil {
+		WriteError(w, r, cause)
+		return
+	}
+
+	w.Header().Set(fallbackStatusHeader, strconv.Itoa(status))
+	w.Header().Set("Cache-Control", "no-store")
+	returnImage(w, r, img, opts.Format)
+}
+
+func parseHexColor(s string) (color.RGBA, error) {
+	s = strings.TrimPrefix(s, "#")
+	if len(s) != 6 {
+		return color.RGBA{}, fmt.Errorf("expected rrggbb, got %q", s)
+	}
+
+	value, err := strconv.ParseUint(s, 16, 32)
+	if err != nil {
+		return color.RGBA{}, fmt.Errorf("expected rrggbb, got %q", s)
+	}
+
+	return color.RGBA{R: uint8(value >> 16), G: uint8(value >> 8), B: uint8(value), A: 255}, nil
+}
+
+// contrastColor picks black or white text, whichever reads better on bg.
+func contrastColor(bg color.RGBA) color.Color {
+	luminance := 299*int(bg.R) + 587*int(bg.G) + 114*int(bg.B)
+	if luminance > 128*1000 {
+		return color.Black
+	}
+
+	return color.White
+}
@@ -0,0 +1,121 @@
+package app
+
+import (
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/heltirj/image_previewer/internal/cache"
+	"github.com/heltirj/image_previewer/internal/config"
+	"github.com/heltirj/image_previewer/internal/logger"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetResizedImageFallback(t *testing.T) {
+	origin := httptest.NewServer(http.NotFoundHandler())
+	defer origin.Close()
+
+	enabled := config.Default()
+	enabled.Fallback.Enabled = true
+
+	tests := []struct {
+		name         string
+		conf         config.Config
+		query        string
+		wantFallback bool
+	}{
+		{"enabled by config", enabled, "", true},
+		{"disabled by config", config.Default(), "", false},
+		{"enabled by request", config.Default(), "fallback=1", true},
+		{"disabled by request", enabled, "fallback=false", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := doPreview(newTestApp(t, tt.conf), previewQuery(120, 80, origin, "/missing.jpg", tt.query))
+
+			if !tt.wantFallback {
+				require.Equal(t, http.StatusNotFound, rec.Code)
+				require.Empty(t, rec.Header().Get(fallbackStatusHeader))
+				return
+			}
+
+			require.Equal(t, http.StatusOK, rec.Code)
+			require.Equal(t, "404", rec.Header().Get(fallbackStatusHeader))
+			require.Equal(t, "no-store", rec.Header().Get("Cache-Control"))
+
+			img, err := jpeg.Decode(rec.Body)
+			require.NoError(t, err)
+			require.Equal(t, image.Rect(0, 0, 120, 80), img.Bounds())
+		})
+	}
+
+	t.Run("invalid parameter", func(t *testing.T) {
+		rec := doPreview(newTestApp(t, config.Default()), previewQuery(120, 80, origin, "/missing.jpg", "fallback=maybe"))
+		require.Equal(t, http.StatusBadRequest, rec.Code)
+	})
+}
+
+func TestPlaceholderImage(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 40, 40))
+	for x := 0; x < 40; x++ {
+		for y := 0; y < 40; y++ {
+			src.Set(x, y, color.RGBA{0, 200, 0, 255})
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "placeholder.png")
+	file, err := os.Create(path)
+	require.NoError(t, err)
+	require.NoError(t, png.Encode(file, src))
+	require.NoError(t, file.Close())
+
+	p, err := newPlaceholder(config.FallbackConfig{Image: path, Color: "ffffff"})
+	require.NoError(t, err)
+
+	img, err := p.render(30, 10, http.StatusNotFound)
+	require.NoError(t, err)
+	require.Equal(t, image.Rect(0, 0, 30, 10), img.Bounds())
+	require.Equal(t, color.RGBAModel.Convert(color.RGBA{0, 200, 0, 255}), color.RGBAModel.Convert(img.At(15, 5)))
+}
+
+func TestPlaceholderSolidColor(t *testing.T) {
+	p, err := newPlaceholder(config.FallbackConfig{Color: "#102030"})
+	require.NoError(t, err)
+
+	img, err := p.render(200, 100, http.StatusBadGateway)
+	require.NoError(t, err)
+	require.Equal(t, color.RGBA{0x10, 0x20, 0x30, 255}, img.At(0, 0))
+
+	var textPixels int
+	for x := 0; x < 200; x++ {
+		if img.At(x, 50) == (color.RGBA{255, 255, 255, 255}) {
+			textPixels++
+		}
+	}
+	require.Positive(t, textPixels, "status text must be drawn")
+}
+
+func TestNewInvalidFallback(t *testing.T) {
+	logg := logger.New(logger.LogLevelError)
+
+	conf := config.Default()
+	conf.Fallback.Color = "red"
+	_, err := New(logg, cache.NewLruImageCache(1, t.TempDir()), &conf)
+	require.Error(t, err)
+
+	conf = config.Default()
+	conf.Fallback.Image = filepath.Join(t.TempDir(), "missing.png")
+	_, err = New(logg, cache.NewLruImageCache(1, t.TempDir()), &conf)
+	require.Error(t, err)
+}
+
+func boolPtr(b bool) *bool {
+	return &b
+}
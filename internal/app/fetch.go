@@ -0,0 +1,311 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/heltirj/image_previewer/internal/config"
+)
+
+var (
+	ErrSourceTooLarge   = errors.New("source image is too large")
+	ErrInsecureRedirect = errors.New("redirect from https to http")
+)
+
+// schemeRe matches an explicit scheme in the route; ServeMux cleans "//" into "/".
+var schemeRe = regexp.MustCompile(`^(?i)(https?):/{1,2}`)
+
+// neverForwarded lists client headers that must not reach the origin even if allowlisted.
+var neverForwarded = map[string]struct{}{
+	"Cookie":              {},
+	"Authorization":       {},
+	"Proxy-Authorization": {},
+}
+
+// maxRedirects is the limit of the default http.Client policy.
+const maxRedirects = 10
+
+func newClient(conf config.FetchConfig, hosts map[string]config.HostConfig) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{Timeout: conf.ConnectTimeout}).DialContext
+	transport.TLSHandshakeTimeout = conf.ConnectTimeout
+	transport.ResponseHeaderTimeout = conf.HeaderTimeout
+
+	return &http.Client{
+		Transport:     transport,
+		Timeout:       conf.Timeout,
+		CheckRedirect: redirectPolicy(hosts),
+	}
+}
+
+// redirectPolicy refuses redirects from https to http unless the target host is
+// configured with the http scheme, so that a source is not silently downgraded, and
+// redirects to http for hosts whose settings must not go over it.
+//
+// It also keeps the static headers and credentials of a host from following its
+// redirects to another host: http.Client copies custom headers to any host and strips
+// Authorization only for other domains. The redirected request gets the settings of
+// the host it goes to instead.
+func redirectPolicy(hosts map[string]config.HostConfig) func(*http.Request, []*http.Request) error {
+	return func(req *http.Request, via []*http.Request) error {
+		if len(via) >= maxRedirects {
+			return fmt.Errorf("stopped after %d redirects", maxRedirects)
+		}
+
+		from, to := via[0].URL.Hostname(), req.URL.Hostname()
+		downgraded := via[len(via)-1].URL.Scheme == "https" && hosts[to].Scheme != "http"
+		if req.URL.Scheme == "http" && (downgraded || !plainHTTPAllowed(hosts[to])) {
+			return fmt.Errorf("%w: %s", ErrInsecureRedirect, req.URL.Redacted())
+		}
+
+		// The headers of every redirect are copied from the first request.
+		if from == to {
+			return nil
+		}
+
+		if host, ok := hosts[from]; ok {
+			for name := range host.Headers {
+				req.Header.Del(name)
+			}
+			if host.BasicAuth != nil {
+				req.Header.Del("Authorization")
+			}
+		}
+
+		if host, ok := hosts[to]; ok {
+			setHostHeaders(req, host)
+		}
+
+		return nil
+	}
+}
+
+func (a *App) doRequest(ctx context.Context, target *url.URL, header http.Header) (*http.Response, error) {
+	req, err := a.newUpstreamRequest(ctx, target, header)
+	if err != nil {
+		return nil, newError(KindBadRequest, fmt.Errorf("failed to create request: %w", err))
+	}
+
+	host := target.Host
+	for attempt := 0; ; attempt++ {
+		if err := a.breakers.allow(host); err != nil {
+			return nil, newError(KindUnavailable, fmt.Errorf("%w: %s", err, host))
+		}
+
+		resp, err := a.client.Do(req)
+		if errors.Is(err, ErrInsecureRedirect) {
+			// The origin answered, it is the redirect that is not acceptable.
+			a.breakers.success(host)
+			return nil, newError(KindUpstreamFailure, err)
+		}
+
+		switch {
+		case err != nil && ctx.Err() != nil:
+			// The client went away or its deadline passed, which says nothing about
+			// the origin.
+			a.breakers.release(host)
+		case err != nil || resp.StatusCode >= http.StatusInternalServerError:
+			a.breakers.failure(host)
+		default:
+			a.breakers.success(host)
+		}
+
+		if attempt >= a.fetch.Retry.Attempts || !isRetryable(resp, err) {
+			if err != nil {
+				return nil, fetchError(fmt.Errorf("failed to do request with %s: %w", target.Scheme, err))
+			}
+			return resp, nil
+		}
+
+		if resp != nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+
+		delay := backoff(a.fetch.Retry, attempt)
+		a.Logger.WarnKV("retrying source request", "url", target.String(), "attempt", attempt+1,
+			"delay", delay, "error", err)
+
+		select {
+		case <-ctx.Done():
+			return nil, fetchError(fmt.Errorf("failed to do request with %s: %w", target.Scheme, ctx.Err()))
+		case <-time.After(delay):
+		}
+	}
+}
+
+// isRetryable reports whether a failed attempt is safe to repeat: the connection
+// to the origin could not be established or a gateway reported a transient error.
+func isRetryable(resp *http.Response, err error) bool {
+	if err != nil {
+		var opErr *net.OpError
+		return errors.As(err, &opErr) && opErr.Op == "dial"
+	}
+
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	default:
+		return false
+	}
+}
+
+// backoff returns a full-jitter exponential delay for the given attempt.
+func backoff(conf config.RetryConfig, attempt int) time.Duration {
+	limit := conf.InitialBackoff << attempt
+	if limit <= 0 || (conf.MaxBackoff > 0 && limit > conf.MaxBackoff) {
+		limit = conf.MaxBackoff
+	}
+
+	if limit <= 0 {
+		return 0
+	}
+
+	return time.Duration(rand.Int64N(int64(limit)) + 1) //nolint:gosec
+}
+
+// resolveSourceURL turns the source part of the route into an absolute URL. An explicit
+// scheme in the route wins; otherwise the host's configured scheme or the default one is used.
+func (a *App) resolveSourceURL(imgURL string) (*url.URL, error) {
+	var scheme string
+	if matches := schemeRe.FindStringSubmatch(imgURL); matches != nil {
+		scheme = strings.ToLower(matches[1])
+		imgURL = imgURL[len(matches[0]):]
+	}
+
+	target, err := url.Parse("//" + imgURL)
+	if err != nil {
+		return nil, err
+	}
+
+	if target.Host == "" {
+		return nil, errors.New("source host is empty")
+	}
+
+	if scheme == "" {
+		scheme = a.fetch.DefaultScheme
+		if host, ok := a.hosts[target.Hostname()]; ok && host.Scheme != "" {
+			scheme = host.Scheme
+		}
+	}
+
+	if scheme != "http" && scheme != "https" {
+		return nil, fmt.Errorf("unsupported scheme: %s", scheme)
+	}
+
+	if host, ok := a.hosts[target.Hostname()]; ok && scheme == "http" && !plainHTTPAllowed(host) {
+		return nil, fmt.Errorf("plain http is not allowed for host %s", target.Hostname())
+	}
+
+	target.Scheme = scheme
+	return target, nil
+}
+
+// plainHTTPAllowed reports whether the host may be requested over plain http: a host
+// configured with https is never downgraded, and static headers and credentials only
+// go over http to hosts configured with it explicitly.
+func plainHTTPAllowed(host config.HostConfig) bool {
+	switch host.Scheme {
+	case "http":
+		return true
+	case "https":
+		return false
+	default:
+		return len(host.Headers) == 0 && host.BasicAuth == nil
+	}
+}
+
+// newUpstreamRequest builds a GET request to the origin. Only allowlisted client
+// headers are forwarded; per-host static headers and credentials come from config.
+func (a *App) newUpstreamRequest(ctx context.Context, target *url.URL, header http.Header) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range a.fetch.ForwardHeaders {
+		name = http.CanonicalHeaderKey(name)
+		if _, denied := neverForwarded[name]; denied {
+			continue
+		}
+
+		if values := header.Values(name); len(values) > 0 {
+			req.Header[name] = append([]string(nil), values...)
+		}
+	}
+
+	if a.fetch.UserAgent != "" {
+		req.Header.Set("User-Agent", a.fetch.UserAgent)
+	}
+
+	if host, ok := a.hosts[target.Hostname()]; ok {
+		setHostHeaders(req, host)
+	}
+
+	return req, nil
+}
+
+// setHostHeaders adds the static headers and credentials configured for the host.
+func setHostHeaders(req *http.Request, host config.HostConfig) {
+	for name, value := range host.Headers {
+		req.Header.Set(name, value)
+	}
+
+	if host.BasicAuth != nil {
+		req.SetBasicAuth(host.BasicAuth.Username, host.BasicAuth.Password)
+	}
+}
+
+// readSource reads the response body, refusing sources larger than maxBytes
+// either by the declared Content-Length or by the actual body size.
+func readSource(resp *http.Response, maxBytes int64) ([]byte, error) {
+	if maxBytes <= 0 {
+		data, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, fetchError(fmt.Errorf("failed to read source: %w", err))
+		}
+		return data, nil
+	}
+
+	if resp.ContentLength > maxBytes {
+		return nil, newError(KindTooLarge, fmt.Errorf("%w: %d bytes", ErrSourceTooLarge, resp.ContentLength))
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxBytes+1))
+	if err != nil {
+		return nil, fetchError(fmt.Errorf("failed to read source: %w", err))
+	}
+
+	if int64(len(data)) > maxBytes {
+		return nil, newError(KindTooLarge, fmt.Errorf("%w: more than %d bytes", ErrSourceTooLarge, maxBytes))
+	}
+
+	return data, nil
+}
+
+// fetchError classifies a transport failure talking to the origin.
+func fetchError(err error) error {
+	if isTimeout(err) {
+		return newError(KindTimeout, err)
+	}
+
+	return newError(KindUpstreamFailure, err)
+}
+
+func isTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
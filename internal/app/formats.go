@@ -0,0 +1,46 @@
+package app
+
+import (
+	"fmt"
+	"mime"
+	"slices"
+
+	// Decoders of source formats besides the ones the service also encodes to.
+	_ "golang.org/x/image/bmp"
+	_ "golang.org/x/image/tiff"
+	_ "golang.org/x/image/webp"
+)
+
+// sourceContentTypes are the media types origins send for each decodable format, keyed
+// by the format name reported by image.Decode.
+var sourceContentTypes = map[string][]string{
+	"jpeg": {"image/jpeg", "image/jpg", "image/pjpeg"},
+	"png":  {"image/png", "image/apng"},
+	"gif":  {"image/gif"},
+	"webp": {"image/webp"},
+	"bmp":  {"image/bmp", "image/x-bmp", "image/x-ms-bmp"},
+	"tiff": {"image/tiff"},
+}
+
+// binaryContentTypes are the generic types that say nothing about the format.
+var binaryContentTypes = []string{"application/octet-stream", "binary/octet-stream"}
+
+// checkContentType verifies that the Content-Type of the source agrees with the format
+// sniffed from its data. A missing or generic binary type is accepted.
+func checkContentType(contentType, format string) error {
+	if contentType == "" {
+		return nil
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return newError(KindUnsupportedMedia, fmt.Errorf("invalid source content type %q: %w", contentType, err))
+	}
+
+	if slices.Contains(binaryContentTypes, mediaType) || slices.Contains(sourceContentTypes[format], mediaType) {
+		return nil
+	}
+
+	return newError(KindUnsupportedMedia,
+		fmt.Errorf("source content type %s does not match its %s data", mediaType, format))
+}
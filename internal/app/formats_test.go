@@ -0,0 +1,112 @@
+package app
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/heltirj/image_previewer/internal/config"
+	"github.com/stretchr/testify/require"
+)
+
+// The webp fixture comes from the golang.org/x/image testdata, the bmp and tiff ones
+// are encoded with golang.org/x/image.
+func TestGetResizedImageSourceFormats(t *testing.T) {
+	a := newTestApp(t, config.Default())
+
+	tests := []struct {
+		fixture     string
+		contentType string
+		status      int
+	}{
+		{"source.webp", "image/webp", http.StatusOK},
+		{"source.bmp", "image/bmp", http.StatusOK},
+		{"source.bmp", "image/x-ms-bmp", http.StatusOK},
+		{"source.tiff", "image/tiff", http.StatusOK},
+		{"source.tiff", "application/octet-stream", http.StatusOK},
+		{"source.webp", "binary/octet-stream", http.StatusOK},
+		{"source.webp", "image/png", http.StatusUnsupportedMediaType},
+		{"source.bmp", "text/html; charset=utf-8", http.StatusUnsupportedMediaType},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.fixture+" as "+tt.contentType, func(t *testing.T) {
+			src, err := os.ReadFile(filepath.Join("testdata", tt.fixture))
+			require.NoError(t, err)
+
+			origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				w.Header().Set("Content-Type", tt.contentType)
+				w.Write(src)
+			}))
+			defer origin.Close()
+
+			rec := doPreview(a, previewPath(30, 20, origin, "/"+tt.fixture))
+			require.Equal(t, tt.status, rec.Code)
+			if tt.status != http.StatusOK {
+				return
+			}
+
+			require.Equal(t, "image/jpeg", rec.Header().Get("Content-Type"))
+
+			img, err := jpeg.Decode(rec.Body)
+			require.NoError(t, err)
+			require.Equal(t, 30, img.Bounds().Dx())
+			require.Equal(t, 20, img.Bounds().Dy())
+		})
+	}
+}
+
+func TestBackground(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, png.Encode(&buf, image.NewNRGBA(image.Rect(0, 0, 40, 40))))
+	src := buf.Bytes()
+
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Write(src)
+	}))
+	defer origin.Close()
+
+	a := newTestApp(t, config.Default())
+
+	tests := []struct {
+		path     string
+		expected color.RGBA
+	}{
+		{previewPath(20, 20, origin, "/transparent.png"), color.RGBA{R: 255, G: 255, B: 255, A: 255}},
+		{previewQuery(20, 20, origin, "/transparent.png", "bg=000080"), color.RGBA{B: 128, A: 255}},
+		{"/preview?fmt=png&w=20&bg=000080&url=" + url.QueryEscape(origin.URL+"/transparent.png"), color.RGBA{}},
+	}
+
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		if strings.HasPrefix(tt.path, "/preview") {
+			a.GetPreview(rec, httptest.NewRequest(http.MethodGet, tt.path, nil))
+		} else {
+			a.GetResizedImage(rec, httptest.NewRequest(http.MethodGet, tt.path, nil))
+		}
+		require.Equal(t, http.StatusOK, rec.Code)
+
+		img, _, err := image.Decode(rec.Body)
+		require.NoError(t, err)
+
+		// JPEG compression may shift the colors slightly.
+		r, g, b, alpha := img.At(10, 10).RGBA()
+		got := []int{int(r >> 8), int(g >> 8), int(b >> 8), int(alpha >> 8)}
+		expected := []int{int(tt.expected.R), int(tt.expected.G), int(tt.expected.B), int(tt.expected.A)}
+		for i := range got {
+			require.InDelta(t, expected[i], got[i], 2, "%s: got %v, want %v", tt.path, got, expected)
+		}
+	}
+
+	rec := doPreview(a, previewQuery(20, 20, origin, "/transparent.png", "bg=blue"))
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+}
@@ -0,0 +1,116 @@
+package app
+
+import (
+	"math"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Client hints the service asks browsers for with Accept-CH. DPR is the legacy name
+// of Sec-CH-DPR still sent by older browsers.
+const (
+	dprHintHeader       = "Sec-CH-DPR"
+	widthHintHeader     = "Sec-CH-Width"
+	legacyDPRHintHeader = "DPR"
+	contentDPRHeader    = "Content-DPR"
+)
+
+// negotiableFormats are the output formats in the order of preference on equal quality.
+var negotiableFormats = []Format{FormatJPEG, FormatPNG, FormatGIF}
+
+// applyHints fills the options the request left to the server from the Accept header
+// and client hints, and lists every header the response depends on in Vary.
+func (a *App) applyHints(w http.ResponseWriter, r *http.Request, opts Options) Options {
+	w.Header().Set("Accept-CH", dprHintHeader+", "+widthHintHeader)
+
+	if opts.Format == "" {
+		w.Header().Add("Vary", "Accept")
+		opts.Format = negotiateFormat(r, preferredFormat(opts.Source))
+	}
+
+	if opts.DPR != 0 {
+		return opts
+	}
+
+	vary := []string{dprHintHeader, legacyDPRHintHeader}
+	dpr := floatHint(r, dprHintHeader)
+	if dpr == 0 {
+		dpr = floatHint(r, legacyDPRHintHeader)
+	}
+
+	// Sec-CH-Width is the slot width in pixels, it overrides the ratio when the
+	// requested width is known.
+	if opts.Width > 0 {
+		vary = append(vary, widthHintHeader)
+		if width := floatHint(r, widthHintHeader); width > 0 {
+			dpr = width / float64(opts.Width)
+		}
+	}
+
+	w.Header().Add("Vary", strings.Join(vary, ", "))
+
+	if dpr == 0 {
+		dpr = 1
+	}
+	opts.DPR = min(dpr, a.images.MaxDPR, max(1, a.maxHintDPR(opts)))
+
+	return opts
+}
+
+// maxHintDPR is the largest ratio that keeps the size of opts within the limits: a hint
+// must not turn a valid request into one that is rejected.
+func (a *App) maxHintDPR(opts Options) float64 {
+	limit := math.Inf(1)
+	if a.images.MaxWidth > 0 && opts.Width > 0 {
+		limit = min(limit, float64(a.images.MaxWidth)/float64(opts.Width))
+	}
+
+	if a.images.MaxHeight > 0 && opts.Height > 0 {
+		limit = min(limit, float64(a.images.MaxHeight)/float64(opts.Height))
+	}
+
+	return limit
+}
+
+// floatHint returns the positive value of a client hint, 0 when it is absent or malformed.
+func floatHint(r *http.Request, name string) float64 {
+	value, err := strconv.ParseFloat(r.Header.Get(name), 64)
+	if err != nil || !(value > 0) {
+		return 0
+	}
+
+	return value
+}
+
+// negotiateFormat picks the output format the client accepts with the highest quality,
+// preferred on equal quality or when it accepts none of them.
+func negotiateFormat(r *http.Request, preferred Format) Format {
+	ranges := parseAccept(r)
+	if len(ranges) == 0 {
+		return preferred
+	}
+
+	best, bestQuality := preferred, quality(ranges, preferred.ContentType())
+	for _, format := range negotiableFormats {
+		if q := quality(ranges, format.ContentType()); q > bestQuality {
+			best, bestQuality = format, q
+		}
+	}
+
+	return best
+}
+
+// preferredFormat is GIF for sources with the .gif extension, so that animations stay
+// animated unless the client asks for another format, and JPEG otherwise. The format
+// has to be known before the source is fetched as it is part of the cache key.
+func preferredFormat(source string) Format {
+	u, err := url.Parse(source)
+	if err == nil && strings.EqualFold(path.Ext(u.Path), ".gif") {
+		return FormatGIF
+	}
+
+	return FormatJPEG
+}
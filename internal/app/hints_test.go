@@ -0,0 +1,200 @@
+package app
+
+import (
+	"image"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/heltirj/image_previewer/internal/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNegotiateFormat(t *testing.T) {
+	tests := []struct {
+		accept   string
+		source   string
+		expected Format
+	}{
+		{"", "http://example.com/image.jpg", FormatJPEG},
+		{"image/avif,image/webp,image/apng,image/svg+xml,image/*,*/*;q=0.8", "example.com/image.jpg", FormatJPEG},
+		{"image/png", "example.com/image.jpg", FormatPNG},
+		{"image/gif, image/png;q=0.5", "example.com/image.jpg", FormatGIF},
+		{"image/jpeg;q=0, image/*", "example.com/image.jpg", FormatPNG},
+		{"image/webp", "example.com/image.jpg", FormatJPEG},
+		{"text/html, */*;q=0.1", "example.com/image.jpg", FormatJPEG},
+		{"", "example.com/animation.GIF?v=1", FormatGIF},
+		{"image/avif,image/webp,image/apng,image/svg+xml,image/*,*/*;q=0.8", "example.com/animation.gif", FormatGIF},
+		{"image/jpeg, image/gif;q=0.5", "example.com/animation.gif", FormatJPEG},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.accept+" "+tt.source, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.accept != "" {
+				req.Header.Set("Accept", tt.accept)
+			}
+
+			require.Equal(t, tt.expected, negotiateFormat(req, preferredFormat(tt.source)))
+		})
+	}
+}
+
+func TestClientHints(t *testing.T) {
+	src := encodeTestJPEG(t, 800, 800)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Write(src)
+	}))
+	defer origin.Close()
+
+	a := newTestApp(t, config.Default())
+
+	tests := []struct {
+		name         string
+		path         string
+		headers      map[string]string
+		expectedSize image.Rectangle
+		expectedType string
+		expectedDPR  string
+		expectedVary []string
+	}{
+		{
+			name:         "no hints",
+			path:         previewPath(100, 50, origin, "/img.jpg"),
+			expectedSize: image.Rect(0, 0, 100, 50),
+			expectedType: "image/jpeg",
+			expectedVary: []string{"Accept", "Sec-CH-DPR, DPR, Sec-CH-Width"},
+		},
+		{
+			name:         "dpr",
+			path:         previewPath(100, 50, origin, "/img.jpg"),
+			headers:      map[string]string{dprHintHeader: "2"},
+			expectedSize: image.Rect(0, 0, 200, 100),
+			expectedType: "image/jpeg",
+			expectedDPR:  "2",
+			expectedVary: []string{"Accept", "Sec-CH-DPR, DPR, Sec-CH-Width"},
+		},
+		{
+			name:         "width",
+			path:         previewPath(100, 50, origin, "/img.jpg"),
+			headers:      map[string]string{widthHintHeader: "150"},
+			expectedSize: image.Rect(0, 0, 150, 75),
+			expectedType: "image/jpeg",
+			expectedDPR:  "1.5",
+			expectedVary: []string{"Accept", "Sec-CH-DPR, DPR, Sec-CH-Width"},
+		},
+		{
+			name:         "width overrides dpr",
+			path:         previewPath(100, 50, origin, "/img.jpg"),
+			headers:      map[string]string{widthHintHeader: "250", dprHintHeader: "2"},
+			expectedSize: image.Rect(0, 0, 250, 125),
+			expectedType: "image/jpeg",
+			expectedDPR:  "2.5",
+			expectedVary: []string{"Accept", "Sec-CH-DPR, DPR, Sec-CH-Width"},
+		},
+		{
+			name:         "dpr clamped to max",
+			path:         previewPath(100, 50, origin, "/img.jpg"),
+			headers:      map[string]string{dprHintHeader: "5"},
+			expectedSize: image.Rect(0, 0, 300, 150),
+			expectedType: "image/jpeg",
+			expectedDPR:  "3",
+			expectedVary: []string{"Accept", "Sec-CH-DPR, DPR, Sec-CH-Width"},
+		},
+		{
+			name:         "width ignored for auto width",
+			path:         previewPath(0, 50, origin, "/img.jpg"),
+			headers:      map[string]string{widthHintHeader: "300"},
+			expectedSize: image.Rect(0, 0, 50, 50),
+			expectedType: "image/jpeg",
+			expectedVary: []string{"Accept", "Sec-CH-DPR, DPR"},
+		},
+		{
+			name:         "explicit dpr wins",
+			path:         previewQuery(100, 50, origin, "/img.jpg", "dpr=1"),
+			headers:      map[string]string{widthHintHeader: "300", dprHintHeader: "2"},
+			expectedSize: image.Rect(0, 0, 100, 50),
+			expectedType: "image/jpeg",
+			expectedVary: []string{"Accept"},
+		},
+		{
+			name:         "accept",
+			path:         previewPath(100, 50, origin, "/img.jpg"),
+			headers:      map[string]string{"Accept": "image/png", dprHintHeader: "2"},
+			expectedSize: image.Rect(0, 0, 200, 100),
+			expectedType: "image/png",
+			expectedDPR:  "2",
+			expectedVary: []string{"Accept", "Sec-CH-DPR, DPR, Sec-CH-Width"},
+		},
+		{
+			name:         "explicit format wins",
+			path:         "/preview?w=100&h=50&fmt=gif&dpr=1&url=" + origin.URL + "/img.jpg",
+			headers:      map[string]string{"Accept": "image/png"},
+			expectedSize: image.Rect(0, 0, 100, 50),
+			expectedType: "image/gif",
+		},
+	}
+
+	cacheStatuses := make(map[string]string)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			for name, value := range tt.headers {
+				req.Header.Set(name, value)
+			}
+
+			rec := httptest.NewRecorder()
+			if strings.HasPrefix(tt.path, "/preview") {
+				a.GetPreview(rec, req)
+			} else {
+				a.GetResizedImage(rec, req)
+			}
+
+			require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+			require.Equal(t, "Sec-CH-DPR, Sec-CH-Width", rec.Header().Get("Accept-CH"))
+			require.Equal(t, tt.expectedType, rec.Header().Get("Content-Type"))
+			require.Equal(t, tt.expectedDPR, rec.Header().Get(contentDPRHeader))
+			require.Equal(t, tt.expectedVary, rec.Header().Values("Vary"))
+
+			img, _, err := image.Decode(rec.Body)
+			require.NoError(t, err)
+			require.Equal(t, tt.expectedSize, img.Bounds())
+
+			cacheStatuses[tt.name] = rec.Header().Get(cacheStatusHeader)
+		})
+	}
+
+	t.Run("variants are cached separately", func(t *testing.T) {
+		require.Equal(t, "MISS", cacheStatuses["accept"])
+		require.Equal(t, "HIT", cacheStatuses["explicit dpr wins"])
+	})
+}
+
+func TestClientHintsSizeLimit(t *testing.T) {
+	src := encodeTestJPEG(t, 800, 800)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Write(src)
+	}))
+	defer origin.Close()
+
+	a := newTestApp(t, config.Default())
+
+	// Both hints ask for a width of 6000 pixels.
+	for header, value := range map[string]string{dprHintHeader: "2", widthHintHeader: "6000"} {
+		req := httptest.NewRequest(http.MethodGet, previewPath(3000, 100, origin, "/img.jpg"), nil)
+		req.Header.Set(header, value)
+
+		rec := httptest.NewRecorder()
+		a.GetResizedImage(rec, req)
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+		img, _, err := image.Decode(rec.Body)
+		require.NoError(t, err)
+		require.Equal(t, image.Rect(0, 0, 4096, 137), img.Bounds(), header)
+	}
+
+	// An explicit dpr is not capped.
+	rec := doPreview(a, previewQuery(3000, 100, origin, "/img.jpg", "dpr=2"))
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+}
@@ -0,0 +1,87 @@
+package app
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+type mediaRange struct {
+	mediaType string
+	subtype   string
+	quality   float64
+}
+
+// parseAccept parses all Accept header values of the request into media ranges.
+func parseAccept(r *http.Request) []mediaRange {
+	var ranges []mediaRange
+	for _, value := range r.Header.Values("Accept") {
+		for _, part := range strings.Split(value, ",") {
+			params := strings.Split(part, ";")
+			mediaType, subtype, ok := strings.Cut(strings.ToLower(strings.TrimSpace(params[0])), "/")
+			if !ok || mediaType == "" || subtype == "" {
+				continue
+			}
+
+			quality := 1.0
+			for _, param := range params[1:] {
+				key, val, _ := strings.Cut(strings.TrimSpace(param), "=")
+				if strings.EqualFold(key, "q") {
+					if q, err := strconv.ParseFloat(val, 64); err == nil {
+						quality = q
+					}
+				}
+			}
+
+			ranges = append(ranges, mediaRange{mediaType: mediaType, subtype: subtype, quality: quality})
+		}
+	}
+
+	return ranges
+}
+
+// explicitQuality returns the quality of a media type listed in ranges without wildcards.
+func explicitQuality(ranges []mediaRange, mediaType string) float64 {
+	for _, mr := range ranges {
+		if mr.mediaType+"/"+mr.subtype == mediaType {
+			return mr.quality
+		}
+	}
+
+	return 0
+}
+
+// quality returns the quality of a media type given by the most specific matching range.
+func quality(ranges []mediaRange, mediaType string) float64 {
+	typ, subtype, _ := strings.Cut(mediaType, "/")
+
+	q, specificity := 0.0, -1
+	for _, mr := range ranges {
+		var s int
+		switch {
+		case mr.mediaType == typ && mr.subtype == subtype:
+			s = 2
+		case mr.mediaType == typ && mr.subtype == "*":
+			s = 1
+		case mr.mediaType == "*" && mr.subtype == "*":
+			s = 0
+		default:
+			continue
+		}
+
+		if s > specificity {
+			q, specificity = mr.quality, s
+		}
+	}
+
+	return q
+}
+
+// acceptsJSON reports whether the client asked for JSON explicitly; wildcards do not
+// count so that image and browser clients keep getting plain text errors.
+func acceptsJSON(r *http.Request) bool {
+	ranges := parseAccept(r)
+	jsonQuality := explicitQuality(ranges, "application/json")
+
+	return jsonQuality > 0 && jsonQuality >= explicitQuality(ranges, "text/plain")
+}
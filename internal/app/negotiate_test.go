@@ -0,0 +1,22 @@
+package app
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseAccept(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Add("Accept", "Image/WebP;q=0.9, image/*;q=0.5")
+	req.Header.Add("Accept", "application/json; charset=utf-8, broken, */*;q=abc")
+
+	require.Equal(t, []mediaRange{
+		{mediaType: "image", subtype: "webp", quality: 0.9},
+		{mediaType: "image", subtype: "*", quality: 0.5},
+		{mediaType: "application", subtype: "json", quality: 1},
+		{mediaType: "*", subtype: "*", quality: 1},
+	}, parseAccept(req))
+}
@@ -0,0 +1,301 @@
+package app
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/heltirj/image_previewer/internal/config"
+	"github.com/heltirj/image_previewer/internal/imagetransformer"
+)
+
+type Format string
+
+const (
+	FormatJPEG Format = "jpeg"
+	FormatPNG  Format = "png"
+	FormatGIF  Format = "gif"
+)
+
+func (f Format) ContentType() string {
+	return "image/" + string(f)
+}
+
+func (f Format) Extension() string {
+	if f == FormatJPEG {
+		return ".jpg"
+	}
+
+	return "." + string(f)
+}
+
+// Options describe a single preview request regardless of the route it came from. An
+// empty Format is negotiated with the client.
+type Options struct {
+	Width    int
+	Height   int
+	Mode     imagetransformer.Mode
+	Format   Format
+	Source   string
+	Fallback *bool
+	Enlarge  *bool
+	// DPR multiplies Width and Height to get the size in pixels; zero means it was
+	// not requested explicitly.
+	DPR        float64
+	Operations imagetransformer.Operations
+	// Watermark is the name of a configured watermark or "none"; empty means the host or
+	// server default.
+	Watermark string
+	// Frame selects a still frame of an animated source; nil keeps the animation.
+	Frame *int
+	// Background is the rrggbb color transparent images are flattened onto for formats
+	// without alpha; empty means the server default.
+	Background string
+}
+
+const (
+	enlargeParam    = "enlarge"
+	dprParam        = "dpr"
+	operationsParam = "ops"
+	frameParam      = "frame"
+	backgroundParam = "bg"
+)
+
+var re = regexp.MustCompile(`^/(\d+)/(\d+)/(.*)$`)
+
+// parsePathOptions parses the legacy /{width}/{height}/{url} route. Everything after
+// the size, including the query string, belongs to the source URL, so the route takes
+// no other options; they are given to /preview and the compatible routes.
+func parsePathOptions(r *http.Request) (Options, error) {
+	query := r.URL.RequestURI()
+	matches := re.FindStringSubmatch(query)
+	if len(matches) != 4 {
+		return Options{}, fmt.Errorf("invalid query: %s", query)
+	}
+
+	width, err := strconv.Atoi(matches[1])
+	if err != nil {
+		return Options{}, errors.New("invalid width")
+	}
+
+	height, err := strconv.Atoi(matches[2])
+	if err != nil {
+		return Options{}, errors.New("invalid height")
+	}
+
+	return Options{
+		Width:  width,
+		Height: height,
+		Mode:   imagetransformer.ModeFill,
+		Source: matches[3],
+	}, nil
+}
+
+// parseQueryOptions parses the /preview?url=...&w=...&h=...&mode=...&fmt=... route.
+func parseQueryOptions(query url.Values) (Options, error) {
+	opts := Options{
+		Mode:       imagetransformer.ModeFill,
+		Source:     query.Get("url"),
+		Watermark:  query.Get(watermarkParam),
+		Background: query.Get(backgroundParam),
+	}
+
+	var err error
+	if opts.Width, err = intParam(query, "w"); err != nil {
+		return Options{}, err
+	}
+
+	if opts.Height, err = intParam(query, "h"); err != nil {
+		return Options{}, err
+	}
+
+	if mode := query.Get("mode"); mode != "" {
+		opts.Mode = imagetransformer.Mode(mode)
+	}
+
+	if format := query.Get("fmt"); format != "" {
+		opts.Format = Format(format)
+	}
+
+	if opts.Fallback, err = boolParam(query, fallbackParam); err != nil {
+		return Options{}, err
+	}
+
+	if opts.Enlarge, err = boolParam(query, enlargeParam); err != nil {
+		return Options{}, err
+	}
+
+	if value := query.Get(dprParam); value != "" {
+		if opts.DPR, err = strconv.ParseFloat(value, 64); err != nil {
+			return Options{}, errors.New("invalid dpr")
+		}
+	}
+
+	if opts.Operations, err = imagetransformer.ParseOperations(query.Get(operationsParam)); err != nil {
+		return Options{}, err
+	}
+
+	if value := query.Get(frameParam); value != "" {
+		frame, err := strconv.Atoi(value)
+		if err != nil {
+			return Options{}, errors.New("invalid frame")
+		}
+		opts.Frame = &frame
+	}
+
+	return opts, nil
+}
+
+func (o Options) validate() error {
+	if o.Source == "" {
+		return errors.New("source url is empty")
+	}
+
+	if o.Width < 0 || o.Height < 0 || o.Width == 0 && o.Height == 0 {
+		return errors.New("width and height must not be negative and at least one of them must be positive")
+	}
+
+	switch o.Mode {
+	case imagetransformer.ModeFill, imagetransformer.ModeFit, imagetransformer.ModeStretch:
+	default:
+		return fmt.Errorf("unsupported mode: %s", o.Mode)
+	}
+
+	switch o.Format {
+	case FormatJPEG, FormatPNG, FormatGIF:
+	default:
+		return fmt.Errorf("unsupported format: %s", o.Format)
+	}
+
+	if o.Frame != nil && *o.Frame < 0 {
+		return errors.New("frame must not be negative")
+	}
+
+	return nil
+}
+
+// resolve applies the server defaults and the device pixel ratio to opts and checks the
+// resulting size in pixels against the configured limits.
+func (o Options) resolve(conf config.ImageConfig) (Options, error) {
+	if o.Enlarge == nil {
+		o.Enlarge = &conf.Enlarge
+	}
+
+	if o.DPR == 0 {
+		o.DPR = 1
+	}
+
+	if o.Background == "" {
+		o.Background = conf.Background
+	}
+
+	o.Background = strings.ToLower(strings.TrimPrefix(o.Background, "#"))
+	if _, err := parseHexColor(o.Background); err != nil {
+		return Options{}, fmt.Errorf("invalid background: %w", err)
+	}
+
+	if !(o.DPR > 0 && o.DPR <= conf.MaxDPR) {
+		return Options{}, fmt.Errorf("dpr must be in (0, %g]", conf.MaxDPR)
+	}
+
+	o.Width = int(math.Round(float64(o.Width) * o.DPR))
+	o.Height = int(math.Round(float64(o.Height) * o.DPR))
+
+	if conf.MaxWidth > 0 && o.Width > conf.MaxWidth || conf.MaxHeight > 0 && o.Height > conf.MaxHeight {
+		return Options{}, fmt.Errorf("size %dx%d exceeds the limit of %dx%d", o.Width, o.Height,
+			conf.MaxWidth, conf.MaxHeight)
+	}
+
+	return o, nil
+}
+
+// cacheKey derives the storage file name from everything that affects the output image,
+// so that equivalent requests share an entry whatever route they came from. It expects
+// resolved options, whose size is already in pixels.
+func (o Options) cacheKey(source *url.URL) string {
+	o = o.normalized()
+	canonical := fmt.Sprintf("%dx%d|%s|%t|%s|%s", o.Width, o.Height, o.Mode, o.enlarge(), o.Operations,
+		source.String())
+	if o.Frame != nil {
+		canonical += fmt.Sprintf("|frame=%d", *o.Frame)
+	}
+	if o.Format == FormatJPEG {
+		canonical += "|bg=" + o.Background
+	}
+	hash := sha256.Sum256([]byte(canonical))
+
+	return hex.EncodeToString(hash[:]) + o.Format.Extension()
+}
+
+// normalized drops settings that do not affect the output: with one side computed from
+// the aspect ratio every mode scales the whole image.
+func (o Options) normalized() Options {
+	if o.Width == 0 || o.Height == 0 {
+		o.Mode = imagetransformer.ModeFit
+	}
+
+	return o
+}
+
+// transformOptions converts resolved options; the size limits of conf also bound the
+// side computed from the aspect ratio of the source.
+func (o Options) transformOptions(conf config.ImageConfig) imagetransformer.Options {
+	opts := imagetransformer.Options{
+		Width:      o.Width,
+		Height:     o.Height,
+		Mode:       o.Mode,
+		Enlarge:    o.enlarge(),
+		Operations: o.Operations,
+		MaxWidth:   conf.MaxWidth,
+		MaxHeight:  conf.MaxHeight,
+	}
+
+	// JPEG has no alpha channel, transparent pixels would turn black. The background
+	// is validated by resolve.
+	if o.Format == FormatJPEG {
+		opts.Background, _ = parseHexColor(o.Background)
+	}
+
+	return opts
+}
+
+// enlarge reports whether the source may be upscaled; unset means the server default
+// has not been applied yet and upscaling is allowed.
+func (o Options) enlarge() bool {
+	return o.Enlarge == nil || *o.Enlarge
+}
+
+func intParam(query url.Values, name string) (int, error) {
+	value := query.Get(name)
+	if value == "" {
+		return 0, nil
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s", name)
+	}
+
+	return n, nil
+}
+
+func boolParam(query url.Values, name string) (*bool, error) {
+	value := query.Get(name)
+	if value == "" {
+		return nil, nil
+	}
+
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s value", name)
+	}
+
+	return &b, nil
+}
@@ -0,0 +1,380 @@
+package app
+
+import (
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/heltirj/image_previewer/internal/config"
+	"github.com/heltirj/image_previewer/internal/imagetransformer"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseQueryOptions(t *testing.T) {
+	tests := []struct {
+		name     string
+		query    string
+		expected Options
+		wantErr  bool
+	}{
+		{
+			name:  "defaults",
+			query: "url=example.com/img.jpg&w=300&h=200",
+			expected: Options{
+				Width: 300, Height: 200, Mode: imagetransformer.ModeFill, Source: "example.com/img.jpg",
+			},
+		},
+		{
+			name: "all options",
+			query: "url=" + url.QueryEscape("https://example.com/img.jpg?size=big&v=2") +
+				"&w=30&h=20&mode=fit&fmt=png&fallback=1&enlarge=0&dpr=1.5&ops=rotate:90,grayscale",
+			expected: Options{
+				Width: 30, Height: 20, Mode: imagetransformer.ModeFit, Format: FormatPNG,
+				Source: "https://example.com/img.jpg?size=big&v=2", Fallback: boolPtr(true), Enlarge: boolPtr(false),
+				DPR: 1.5, Operations: imagetransformer.Operations{imagetransformer.Rotate(90), imagetransformer.Grayscale{}},
+			},
+		},
+		{
+			name:  "auto height",
+			query: "url=example.com/img.jpg&w=300",
+			expected: Options{
+				Width: 300, Mode: imagetransformer.ModeFill, Source: "example.com/img.jpg",
+			},
+		},
+		{name: "missing url", query: "w=300&h=200", wantErr: true},
+		{name: "negative size", query: "url=example.com/img.jpg&w=-300&h=200", wantErr: true},
+		{name: "missing size", query: "url=example.com/img.jpg", wantErr: true},
+		{name: "invalid width", query: "url=example.com/img.jpg&w=abc&h=200", wantErr: true},
+		{name: "unknown mode", query: "url=example.com/img.jpg&w=300&h=200&mode=zoom", wantErr: true},
+		{name: "invalid operations", query: "url=example.com/img.jpg&w=300&h=200&ops=rotate:45", wantErr: true},
+		{name: "invalid dpr", query: "url=example.com/img.jpg&w=300&h=200&dpr=x", wantErr: true},
+		{name: "invalid enlarge", query: "url=example.com/img.jpg&w=300&h=200&enlarge=maybe", wantErr: true},
+		{name: "unknown format", query: "url=example.com/img.jpg&w=300&h=200&fmt=bmp", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query, err := url.ParseQuery(tt.query)
+			require.NoError(t, err)
+
+			opts, err := parseQueryOptions(query)
+			if err == nil {
+				negotiated := opts
+				if negotiated.Format == "" {
+					negotiated.Format = FormatJPEG
+				}
+				err = negotiated.validate()
+			}
+
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, opts)
+		})
+	}
+}
+
+func TestParsePathOptions(t *testing.T) {
+	for _, path := range []string{
+		"/300/200/example.com/img.jpg",
+		"/300/200/example.com/img.jpg?frame=3&dpr=2&wm=none",
+		"/300/200/example.com/img.jpg?bg=%23ffffff&fallback=1",
+	} {
+		opts, err := parsePathOptions(httptest.NewRequest(http.MethodGet, path, nil))
+		require.NoError(t, err)
+		require.Equal(t, Options{
+			Width: 300, Height: 200, Mode: imagetransformer.ModeFill, Source: path[len("/300/200/"):],
+		}, opts)
+	}
+}
+
+func TestCacheKey(t *testing.T) {
+	source, err := url.Parse("https://example.com/img.jpg?v=1")
+	require.NoError(t, err)
+
+	opts := Options{Width: 300, Height: 200, Mode: imagetransformer.ModeFill, Format: FormatJPEG}
+	key := opts.cacheKey(source)
+	require.Regexp(t, `^[0-9a-f]{64}\.jpg$`, key)
+
+	withFallback := opts
+	withFallback.Fallback = boolPtr(true)
+	require.Equal(t, key, withFallback.cacheKey(source))
+
+	png := opts
+	png.Format = FormatPNG
+	require.Regexp(t, `\.png$`, png.cacheKey(source))
+
+	fit := opts
+	fit.Mode = imagetransformer.ModeFit
+	require.NotEqual(t, key, fit.cacheKey(source))
+
+	noEnlarge := opts
+	noEnlarge.Enlarge = boolPtr(false)
+	require.NotEqual(t, key, noEnlarge.cacheKey(source))
+
+	enlarge := opts
+	enlarge.Enlarge = boolPtr(true)
+	require.Equal(t, key, enlarge.cacheKey(source))
+
+	blur := opts
+	blur.Operations, err = imagetransformer.ParseOperations("blur:1.50")
+	require.NoError(t, err)
+	require.NotEqual(t, key, blur.cacheKey(source))
+
+	sameBlur := opts
+	sameBlur.Operations, err = imagetransformer.ParseOperations("blur:1.5")
+	require.NoError(t, err)
+	require.Equal(t, blur.cacheKey(source), sameBlur.cacheKey(source))
+
+	reordered := opts
+	reordered.Operations, err = imagetransformer.ParseOperations("grayscale,blur:1.5")
+	require.NoError(t, err)
+	require.NotEqual(t, blur.cacheKey(source), reordered.cacheKey(source))
+
+	autoFill := Options{Width: 300, Mode: imagetransformer.ModeFill, Format: FormatJPEG}
+	autoFit := autoFill
+	autoFit.Mode = imagetransformer.ModeFit
+	require.Equal(t, autoFill.cacheKey(source), autoFit.cacheKey(source))
+	require.NotEqual(t, key, autoFill.cacheKey(source))
+
+	black := opts
+	black.Background = "000000"
+	require.NotEqual(t, key, black.cacheKey(source))
+
+	// Formats with alpha are not flattened.
+	pngBlack := png
+	pngBlack.Background = "000000"
+	require.Equal(t, png.cacheKey(source), pngBlack.cacheKey(source))
+
+	firstFrame, zero := opts, 0
+	firstFrame.Frame = &zero
+	require.NotEqual(t, key, firstFrame.cacheKey(source))
+
+	otherQuery, err := url.Parse("https://example.com/img.jpg?v=2")
+	require.NoError(t, err)
+	require.NotEqual(t, key, opts.cacheKey(otherQuery))
+}
+
+func TestGetPreview(t *testing.T) {
+	src := encodeTestJPEG(t, 200, 100)
+	queries := make(chan string, 10)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries <- r.URL.RawQuery
+		w.Write(src)
+	}))
+	defer origin.Close()
+
+	a := newTestApp(t, config.Default())
+
+	preview := func(query url.Values) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		a.GetPreview(rec, httptest.NewRequest(http.MethodGet, "/preview?"+query.Encode(), nil))
+		return rec
+	}
+
+	rec := preview(url.Values{"url": {origin.URL + "/img.jpg?v=1&size=big"}, "w": {"50"}, "h": {"50"},
+		"mode": {"fit"}, "fmt": {"png"}})
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "image/png", rec.Header().Get("Content-Type"))
+	require.Equal(t, "v=1&size=big", <-queries)
+
+	img, err := png.Decode(rec.Body)
+	require.NoError(t, err)
+	require.Equal(t, image.Rect(0, 0, 50, 25), img.Bounds())
+
+	t.Run("shares cache with the path route", func(t *testing.T) {
+		rec := doPreview(a, previewPath(40, 40, origin, "/shared.jpg"))
+		require.Equal(t, http.StatusOK, rec.Code)
+		require.Equal(t, "MISS", rec.Header().Get(cacheStatusHeader))
+		<-queries
+
+		rec = preview(url.Values{"url": {origin.URL + "/shared.jpg"}, "w": {"40"}, "h": {"40"}})
+		require.Equal(t, http.StatusOK, rec.Code)
+		require.Equal(t, "HIT", rec.Header().Get(cacheStatusHeader))
+	})
+
+	t.Run("auto size", func(t *testing.T) {
+		for path, expected := range map[string]image.Rectangle{
+			previewPath(100, 0, origin, "/auto.jpg"): image.Rect(0, 0, 100, 50),
+			previewPath(0, 20, origin, "/auto.jpg"):  image.Rect(0, 0, 40, 20),
+		} {
+			rec := doPreview(a, path)
+			require.Equal(t, http.StatusOK, rec.Code)
+			<-queries
+
+			img, _, err := image.Decode(rec.Body)
+			require.NoError(t, err)
+			require.Equal(t, expected, img.Bounds())
+		}
+
+		rec := doPreview(a, previewPath(0, 0, origin, "/auto.jpg"))
+		require.Equal(t, http.StatusBadRequest, rec.Code)
+	})
+
+	t.Run("operations", func(t *testing.T) {
+		rec := doPreview(a, previewQuery(20, 40, origin, "/ops.jpg", "ops=rotate:90,grayscale"))
+		require.Equal(t, http.StatusOK, rec.Code)
+		require.Empty(t, <-queries)
+
+		img, _, err := image.Decode(rec.Body)
+		require.NoError(t, err)
+		require.Equal(t, image.Rect(0, 0, 20, 40), img.Bounds())
+
+		r, g, b, _ := img.At(10, 20).RGBA()
+		require.InDelta(t, r, g, 0x300)
+		require.InDelta(t, g, b, 0x300)
+
+		rec = doPreview(a, previewQuery(20, 40, origin, "/ops.jpg", "ops=sepia"))
+		require.Equal(t, http.StatusBadRequest, rec.Code)
+	})
+
+	t.Run("invalid options", func(t *testing.T) {
+		rec := preview(url.Values{"url": {origin.URL + "/img.jpg"}, "w": {"50"}, "h": {"50"}, "mode": {"zoom"}})
+		require.Equal(t, http.StatusBadRequest, rec.Code)
+	})
+}
+
+func TestEnlarge(t *testing.T) {
+	src := encodeTestJPEG(t, 200, 100)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Write(src)
+	}))
+	defer origin.Close()
+
+	conf := config.Default()
+	conf.Image.Enlarge = false
+	a := newTestApp(t, conf)
+
+	tests := []struct {
+		name     string
+		path     string
+		expected image.Rectangle
+	}{
+		{"capped by default", previewPath(400, 400, origin, "/img.jpg"), image.Rect(0, 0, 100, 100)},
+		{"not enlarged when fits", previewPath(100, 50, origin, "/img.jpg"), image.Rect(0, 0, 100, 50)},
+		{"enlarged on request", previewQuery(400, 400, origin, "/img.jpg", "enlarge=1"), image.Rect(0, 0, 400, 400)},
+		{
+			"enlarged on preview request",
+			"/preview?" + url.Values{"url": {origin.URL + "/img.jpg"}, "w": {"300"}, "h": {"0"}, "enlarge": {"true"}}.Encode(),
+			image.Rect(0, 0, 300, 150),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			handler := a.GetResizedImage
+			if strings.HasPrefix(tt.path, "/preview") {
+				handler = a.GetPreview
+			}
+			handler(rec, httptest.NewRequest(http.MethodGet, tt.path, nil))
+			require.Equal(t, http.StatusOK, rec.Code)
+			require.Equal(t, strconv.Itoa(tt.expected.Dx()), rec.Header().Get(imageWidthHeader))
+			require.Equal(t, strconv.Itoa(tt.expected.Dy()), rec.Header().Get(imageHeightHeader))
+
+			img, _, err := image.Decode(rec.Body)
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, img.Bounds())
+		})
+	}
+}
+
+func TestResolveOptions(t *testing.T) {
+	conf := config.Default().Image
+
+	tests := []struct {
+		name     string
+		opts     Options
+		expected Options
+		wantErr  bool
+	}{
+		{
+			name:     "defaults",
+			opts:     Options{Width: 300, Height: 200},
+			expected: Options{Width: 300, Height: 200, Enlarge: &conf.Enlarge, DPR: 1, Background: "ffffff"},
+		},
+		{
+			name:     "dpr",
+			opts:     Options{Width: 300, Height: 0, DPR: 1.5, Enlarge: boolPtr(false)},
+			expected: Options{Width: 450, Height: 0, Enlarge: boolPtr(false), DPR: 1.5, Background: "ffffff"},
+		},
+		{
+			name:     "background",
+			opts:     Options{Width: 300, Height: 200, Background: "#FF0000"},
+			expected: Options{Width: 300, Height: 200, Enlarge: &conf.Enlarge, DPR: 1, Background: "ff0000"},
+		},
+		{name: "invalid background", opts: Options{Width: 300, Height: 200, Background: "red"}, wantErr: true},
+		{name: "dpr above max", opts: Options{Width: 300, Height: 200, DPR: 4}, wantErr: true},
+		{name: "negative dpr", opts: Options{Width: 300, Height: 200, DPR: -1}, wantErr: true},
+		{name: "size above max", opts: Options{Width: 5000, Height: 200}, wantErr: true},
+		{name: "size above max with dpr", opts: Options{Width: 2000, Height: 200, DPR: 3}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts, err := tt.opts.resolve(conf)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, opts)
+		})
+	}
+}
+
+func TestDPR(t *testing.T) {
+	src := encodeTestJPEG(t, 800, 800)
+	requests := make(chan struct{}, 10)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		requests <- struct{}{}
+		w.Write(src)
+	}))
+	defer origin.Close()
+
+	a := newTestApp(t, config.Default())
+
+	rec := doPreview(a, previewQuery(300, 200, origin, "/img.jpg", "dpr=2"))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "2", rec.Header().Get(contentDPRHeader))
+	require.Equal(t, []string{"Accept"}, rec.Header().Values("Vary"))
+	require.Equal(t, "600", rec.Header().Get(imageWidthHeader))
+	require.Equal(t, "400", rec.Header().Get(imageHeightHeader))
+	<-requests
+
+	t.Run("shares cache with the same pixel size", func(t *testing.T) {
+		rec := doPreview(a, previewPath(600, 400, origin, "/img.jpg"))
+		require.Equal(t, http.StatusOK, rec.Code)
+		require.Equal(t, "HIT", rec.Header().Get(cacheStatusHeader))
+		require.Empty(t, rec.Header().Get(contentDPRHeader))
+		require.Contains(t, rec.Header().Values("Vary"), "Sec-CH-DPR, DPR, Sec-CH-Width")
+	})
+
+	t.Run("client hint", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, previewPath(200, 200, origin, "/img.jpg"), nil)
+		req.Header.Set(legacyDPRHintHeader, "1.5")
+		rec := httptest.NewRecorder()
+		a.GetResizedImage(rec, req)
+		require.Equal(t, http.StatusOK, rec.Code)
+		require.Equal(t, "1.5", rec.Header().Get(contentDPRHeader))
+		require.Equal(t, "300", rec.Header().Get(imageWidthHeader))
+		<-requests
+	})
+
+	t.Run("limits", func(t *testing.T) {
+		rec := doPreview(a, previewQuery(300, 200, origin, "/img.jpg", "dpr=10"))
+		require.Equal(t, http.StatusBadRequest, rec.Code)
+
+		rec = doPreview(a, previewQuery(2000, 200, origin, "/img.jpg", "dpr=3"))
+		require.Equal(t, http.StatusBadRequest, rec.Code)
+	})
+}
@@ -0,0 +1,74 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"time"
+)
+
+var ErrOverloaded = errors.New("too many images are being processed")
+
+// pool limits the number of images processed at once. Jobs beyond the concurrency wait
+// in a queue of bounded depth; when it is full they are rejected right away instead of
+// piling up in memory.
+type pool struct {
+	workers chan struct{}
+	// admitted holds a token for every running or queued job.
+	admitted chan struct{}
+}
+
+func newPool(concurrency, queueSize int) *pool {
+	if concurrency <= 0 {
+		concurrency = runtime.NumCPU()
+	}
+
+	return &pool{
+		workers:  make(chan struct{}, concurrency),
+		admitted: make(chan struct{}, concurrency+max(0, queueSize)),
+	}
+}
+
+// admit takes a place in the queue, which is held until release is called. Taking it
+// before the source is downloaded also bounds the memory held by the downloaded data.
+func (p *pool) admit() (release func(), err error) {
+	select {
+	case p.admitted <- struct{}{}:
+	default:
+		return nil, newError(KindOverloaded, ErrOverloaded)
+	}
+
+	return func() { <-p.admitted }, nil
+}
+
+// wait takes a place in the queue like admit, but waits for one to free up instead of
+// failing when the queue is full.
+func (p *pool) wait(ctx context.Context) (release func(), err error) {
+	select {
+	case p.admitted <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	return func() { <-p.admitted }, nil
+}
+
+// work calls f of an admitted job once a worker is free and returns the time spent
+// waiting for it. The job was admitted, so giving up the wait is not an overload: it
+// is the request that timed out or was canceled.
+func (p *pool) work(ctx context.Context, f func() error) (time.Duration, error) {
+	start := time.Now()
+	select {
+	case p.workers <- struct{}{}:
+	case <-ctx.Done():
+		kind := KindInternal
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			kind = KindTimeout
+		}
+		return time.Since(start), newError(kind, fmt.Errorf("waiting for a worker: %w", ctx.Err()))
+	}
+	defer func() { <-p.workers }()
+
+	return time.Since(start), f()
+}
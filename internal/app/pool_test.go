@@ -0,0 +1,137 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/heltirj/image_previewer/internal/config"
+	"github.com/stretchr/testify/require"
+)
+
+// runJob admits f and runs it as generate does.
+func runJob(ctx context.Context, p *pool, f func() error) (time.Duration, error) {
+	release, err := p.admit()
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+
+	return p.work(ctx, f)
+}
+
+func TestPool(t *testing.T) {
+	p := newPool(1, 1)
+
+	running, release := make(chan struct{}), make(chan struct{})
+	go runJob(context.Background(), p, func() error {
+		close(running)
+		<-release
+		return nil
+	})
+	<-running
+
+	queued := make(chan time.Duration)
+	go func() {
+		wait, _ := runJob(context.Background(), p, func() error { return nil })
+		queued <- wait
+	}()
+
+	// The second job takes the only queue slot, so the third is rejected.
+	require.Eventually(t, func() bool { return len(p.admitted) == 2 }, time.Second, time.Millisecond)
+	_, err := p.admit()
+	require.ErrorIs(t, err, ErrOverloaded)
+	require.Equal(t, KindOverloaded, errorKind(err))
+
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	require.GreaterOrEqual(t, <-queued, 20*time.Millisecond)
+
+	jobErr := errors.New("failed")
+	_, err = runJob(context.Background(), p, func() error { return jobErr })
+	require.ErrorIs(t, err, jobErr)
+	require.Empty(t, p.admitted)
+}
+
+func TestPoolCanceled(t *testing.T) {
+	p := newPool(1, 1)
+	p.workers <- struct{}{}
+
+	timeout, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	for ctx, kind := range map[context.Context]ErrorKind{timeout: KindTimeout, canceled: KindInternal} {
+		release, err := p.admit()
+		require.NoError(t, err)
+
+		called := false
+		_, err = p.work(ctx, func() error {
+			called = true
+			return nil
+		})
+		release()
+
+		require.ErrorIs(t, err, ctx.Err())
+		require.Equal(t, kind, errorKind(err))
+		require.False(t, called)
+	}
+	require.Empty(t, p.admitted)
+}
+
+func TestGetResizedImageOverloaded(t *testing.T) {
+	src := encodeTestJPEG(t, 100, 100)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Write(src)
+	}))
+	defer origin.Close()
+
+	conf := config.Default()
+	conf.Processing = config.ProcessingConfig{Concurrency: 1, QueueSize: 0, RetryAfter: 1500 * time.Millisecond}
+	a := newTestApp(t, conf)
+	a.pool.admitted <- struct{}{}
+
+	rec := doPreview(a, previewPath(50, 50, origin, "/busy.jpg"))
+	require.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	require.Equal(t, "2", rec.Header().Get("Retry-After"))
+
+	<-a.pool.admitted
+	rec = doPreview(a, previewPath(50, 50, origin, "/busy.jpg"))
+	require.Equal(t, http.StatusOK, rec.Code)
+}
+
+func TestGetResizedImageOverloadedBeforeDownload(t *testing.T) {
+	src := encodeTestJPEG(t, 100, 100)
+	sendBody := make(chan struct{})
+	defer close(sendBody)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		select {
+		case <-sendBody:
+		case <-r.Context().Done():
+		}
+		w.Write(src)
+	}))
+	defer origin.Close()
+
+	conf := config.Default()
+	conf.Processing = config.ProcessingConfig{Concurrency: 1, QueueSize: 0, RetryAfter: time.Second}
+	a := newTestApp(t, conf)
+	a.pool.admitted <- struct{}{}
+
+	// The body is never sent, so the request is rejected without downloading it.
+	done := make(chan int)
+	go func() { done <- doPreview(a, previewPath(50, 50, origin, "/busy.jpg")).Code }()
+
+	select {
+	case code := <-done:
+		require.Equal(t, http.StatusServiceUnavailable, code)
+	case <-time.After(time.Second):
+		t.Fatal("the source is downloaded before the request is admitted")
+	}
+}
@@ -0,0 +1,78 @@
+package app
+
+import (
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	cacheStatusHeader = "X-Cache-Status"
+
+	warningStale              = `110 - "Response is Stale"`
+	warningRevalidationFailed = `111 - "Revalidation Failed"`
+)
+
+type entryFreshness int
+
+const (
+	entryFresh entryFreshness = iota
+	entryStale
+	entryExpired
+)
+
+// freshness classifies a cache entry by age: fresh entries are served as is, stale ones
+// are served while being refreshed in the background and expired ones are regenerated.
+func (a *App) freshness(savedAt time.Time) entryFreshness {
+	if a.caching.TTL <= 0 {
+		return entryFresh
+	}
+
+	age := time.Since(savedAt)
+	switch {
+	case age < a.caching.TTL:
+		return entryFresh
+	case age < a.caching.TTL+a.caching.StaleWhileRevalidate:
+		return entryStale
+	default:
+		return entryExpired
+	}
+}
+
+func (a *App) canServeStaleOnError(savedAt time.Time) bool {
+	return time.Since(savedAt) < a.caching.TTL+a.caching.StaleIfError
+}
+
+// revalidate regenerates the entry in the background; concurrent calls for the
+// same key are collapsed into one.
+func (a *App) revalidate(key string, header http.Header, target *url.URL, opts Options) {
+	if _, running := a.revalidating.LoadOrStore(key, struct{}{}); running {
+		return
+	}
+
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+		defer a.revalidating.Delete(key)
+		defer func() {
+			if recovered := recover(); recovered != nil {
+				a.logPanic(recovered, "revalidation panicked", "key", key)
+			}
+		}()
+
+		img, _, err := a.generate(a.ctx, header, target, opts, a.pool.admit)
+		if err != nil {
+			a.Logger.WarnKV("failed to revalidate image", "key", key, "error", err)
+			return
+		}
+
+		if err := a.Cache.Save(key, img); err != nil {
+			a.Logger.ErrorKV("failed to save revalidated image", "key", key, "error", err)
+		}
+	}()
+}
+
+func markStale(w http.ResponseWriter, warning string) {
+	w.Header().Set("Warning", warning)
+	w.Header().Set(cacheStatusHeader, "STALE")
+}
@@ -0,0 +1,349 @@
+package app
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	// maxWarmupItems limits the previews a single job may generate.
+	maxWarmupItems = 1000
+	// maxWarmupJobs is the number of jobs whose status is kept; the oldest finished
+	// jobs are forgotten first.
+	maxWarmupJobs = 100
+	// maxActiveWarmups limits the jobs pending or running at once, further requests are
+	// rejected until one of them finishes.
+	maxActiveWarmups = 4
+	// maxWarmupBody limits the size of a warmup request.
+	maxWarmupBody = 1 << 20
+)
+
+var ErrTooManyWarmups = errors.New("too many warmup jobs are running")
+
+// Statuses of warmup jobs and of their items.
+const (
+	WarmupPending = "pending"
+	WarmupRunning = "running"
+	WarmupDone    = "done"
+	WarmupCached  = "cached"
+	WarmupFailed  = "failed"
+)
+
+// warmupRequest is the body of POST /warmup: every source is generated in every size.
+// Sizes are /preview parameters such as "w=300&h=200&mode=fit", presets are names of
+// the configured ones.
+type warmupRequest struct {
+	URLs    []string `json:"urls"`
+	Sizes   []string `json:"sizes"`
+	Presets []string `json:"presets"`
+}
+
+// WarmupJob reports the progress of a warmup request.
+type WarmupJob struct {
+	ID       string       `json:"id"`
+	Status   string       `json:"status"`
+	Total    int          `json:"total"`
+	Done     int          `json:"done"`
+	Failed   int          `json:"failed"`
+	Created  time.Time    `json:"created"`
+	Finished *time.Time   `json:"finished,omitempty"`
+	Items    []WarmupItem `json:"items"`
+}
+
+// WarmupItem is a single preview of a warmup job. Size is the preset name or the
+// parameters it was requested with.
+type WarmupItem struct {
+	URL    string `json:"url"`
+	Size   string `json:"size"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+
+	opts Options
+}
+
+// warmups keeps the warmup jobs for the status endpoint.
+type warmups struct {
+	mu     sync.Mutex
+	jobs   map[string]*WarmupJob
+	order  []string
+	active int
+}
+
+func newWarmups() *warmups {
+	return &warmups{jobs: make(map[string]*WarmupJob)}
+}
+
+// add registers a job, forgetting the oldest finished one when there are too many. As
+// fewer jobs are active than kept, there is always a finished one to forget.
+func (ws *warmups) add(job *WarmupJob) error {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	if ws.active >= maxActiveWarmups {
+		return ErrTooManyWarmups
+	}
+
+	if len(ws.order) >= maxWarmupJobs {
+		for i, id := range ws.order {
+			if ws.jobs[id].Status == WarmupDone {
+				delete(ws.jobs, id)
+				ws.order = append(ws.order[:i], ws.order[i+1:]...)
+				break
+			}
+		}
+	}
+
+	ws.jobs[job.ID] = job
+	ws.order = append(ws.order, job.ID)
+	ws.active++
+
+	return nil
+}
+
+// finish marks the job done, once.
+func (ws *warmups) finish(job *WarmupJob) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	if job.Status == WarmupDone {
+		return
+	}
+
+	finished := time.Now()
+	job.Status = WarmupDone
+	job.Finished = &finished
+	ws.active--
+}
+
+// get returns a copy of the job that is safe to read while it runs.
+func (ws *warmups) get(id string) (WarmupJob, bool) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	job, ok := ws.jobs[id]
+	if !ok {
+		return WarmupJob{}, false
+	}
+
+	snapshot := *job
+	snapshot.Items = append([]WarmupItem(nil), job.Items...)
+
+	return snapshot, true
+}
+
+// update runs f, which changes a job, under the lock.
+func (ws *warmups) update(f func()) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	f()
+}
+
+// Warmup accepts a batch of sources and sizes and generates the previews into the cache
+// in the background. It answers with the job, whose progress is reported by
+// WarmupStatus.
+func (a *App) Warmup(w http.ResponseWriter, r *http.Request) {
+	var req warmupRequest
+	body := http.MaxBytesReader(w, r.Body, maxWarmupBody)
+	if err := json.NewDecoder(body).Decode(&req); err != nil {
+		WriteError(w, r, newError(KindBadRequest, fmt.Errorf("invalid warmup request: %w", err)))
+		return
+	}
+
+	items, err := a.warmupItems(req)
+	if err != nil {
+		WriteError(w, r, newError(KindBadRequest, err))
+		return
+	}
+
+	job := &WarmupJob{
+		ID:      newWarmupID(),
+		Status:  WarmupPending,
+		Total:   len(items),
+		Created: time.Now(),
+		Items:   items,
+	}
+	if err := a.warmups.add(job); err != nil {
+		WriteError(w, r, newError(KindOverloaded, err))
+		return
+	}
+
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+		defer func() {
+			if recovered := recover(); recovered != nil {
+				a.logPanic(recovered, "warmup panicked", "job", job.ID)
+				a.warmups.finish(job)
+			}
+		}()
+
+		a.runWarmup(job)
+	}()
+
+	snapshot, _ := a.warmups.get(job.ID)
+	w.Header().Set("Location", "/warmup/"+job.ID)
+	writeJSON(w, http.StatusAccepted, snapshot)
+}
+
+// WarmupStatus reports the progress of the warmup job given by the id path value.
+func (a *App) WarmupStatus(w http.ResponseWriter, r *http.Request) {
+	job, ok := a.warmups.get(r.PathValue("id"))
+	if !ok {
+		WriteError(w, r, newError(KindNotFound, errors.New("unknown warmup job")))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, job)
+}
+
+// warmupItems pairs every source with every size; the sizes are parsed up front, so
+// that a malformed request is rejected as a whole.
+func (a *App) warmupItems(req warmupRequest) ([]WarmupItem, error) {
+	type size struct {
+		name  string
+		query url.Values
+	}
+
+	sizes := make([]size, 0, len(req.Sizes)+len(req.Presets))
+	for _, name := range req.Presets {
+		preset, ok := a.images.Presets[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown preset: %s", name)
+		}
+
+		query, err := url.ParseQuery(preset)
+		if err != nil {
+			return nil, fmt.Errorf("invalid preset %s: %w", name, err)
+		}
+		sizes = append(sizes, size{name, query})
+	}
+
+	for _, params := range req.Sizes {
+		query, err := url.ParseQuery(params)
+		if err != nil {
+			return nil, fmt.Errorf("invalid size %s: %w", params, err)
+		}
+		sizes = append(sizes, size{params, query})
+	}
+
+	if len(req.URLs) == 0 || len(sizes) == 0 {
+		return nil, errors.New("urls and sizes or presets must not be empty")
+	}
+
+	if len(req.URLs)*len(sizes) > maxWarmupItems {
+		return nil, fmt.Errorf("too many previews, at most %d are allowed", maxWarmupItems)
+	}
+
+	items := make([]WarmupItem, 0, len(req.URLs)*len(sizes))
+	for _, source := range req.URLs {
+		for _, s := range sizes {
+			s.query.Set("url", source)
+			opts, err := parseQueryOptions(s.query)
+			if err != nil {
+				return nil, fmt.Errorf("invalid size %s: %w", s.name, err)
+			}
+
+			// Without a request to negotiate with, the format is the one chosen for
+			// clients that accept anything.
+			if opts.Format == "" {
+				opts.Format = preferredFormat(opts.Source)
+			}
+
+			items = append(items, WarmupItem{URL: source, Size: s.name, Status: WarmupPending, opts: opts})
+		}
+	}
+
+	return items, nil
+}
+
+// runWarmup generates the items of job one by one, so that a job takes a single place in
+// the processing pool and requests of clients keep priority. Items left when the app is
+// closed fail.
+func (a *App) runWarmup(job *WarmupJob) {
+	a.warmups.update(func() { job.Status = WarmupRunning })
+
+	for i := range job.Items {
+		status, err := WarmupFailed, a.ctx.Err()
+		if err == nil {
+			status, err = a.warmupItem(job.Items[i].opts)
+		}
+		if err != nil {
+			a.Logger.WarnKV("failed to warm up image", "job", job.ID, "url", job.Items[i].URL,
+				"size", job.Items[i].Size, "error", err)
+		}
+
+		a.warmups.update(func() {
+			item := &job.Items[i]
+			item.Status = status
+			job.Done++
+			if err != nil {
+				item.Error = err.Error()
+				job.Failed++
+			}
+		})
+	}
+
+	a.warmups.finish(job)
+
+	a.Logger.InfoKV("warmup finished", "job", job.ID, "total", job.Total, "failed", job.Failed)
+}
+
+// warmupItem generates a preview unless a fresh one is cached. Warming up is never
+// urgent, so it waits for a place in the processing queue before the source is
+// downloaded instead of being rejected when the queue is full.
+func (a *App) warmupItem(opts Options) (string, error) {
+	opts, target, err := a.prepare(opts)
+	if err != nil {
+		return WarmupFailed, err
+	}
+
+	key := opts.cacheKey(target)
+	if _, savedAt, ok := a.Cache.Lookup(key); ok && a.freshness(savedAt) == entryFresh {
+		return WarmupCached, nil
+	}
+
+	release, err := a.pool.wait(a.ctx)
+	if err != nil {
+		return WarmupFailed, err
+	}
+	defer release()
+
+	admitted := func() (func(), error) { return func() {}, nil }
+	img, _, err := a.generate(a.ctx, http.Header{}, target, opts, admitted)
+	if err != nil {
+		return WarmupFailed, err
+	}
+
+	if err := a.Cache.Save(key, img); err != nil {
+		return WarmupFailed, err
+	}
+
+	return WarmupDone, nil
+}
+
+func newWarmupID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+
+	return hex.EncodeToString(id)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(append(body, '\n'))
+}
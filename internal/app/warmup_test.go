@@ -0,0 +1,238 @@
+package app
+
+import (
+	"encoding/json"
+	"image"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/heltirj/image_previewer/internal/config"
+	"github.com/stretchr/testify/require"
+)
+
+func postWarmup(a *App, body string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	a.Warmup(rec, httptest.NewRequest(http.MethodPost, "/warmup", strings.NewReader(body)))
+
+	return rec
+}
+
+func warmupStatus(t *testing.T, a *App, id string) WarmupJob {
+	t.Helper()
+
+	req := httptest.NewRequest(http.MethodGet, "/warmup/"+id, nil)
+	req.SetPathValue("id", id)
+	rec := httptest.NewRecorder()
+	a.WarmupStatus(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	var job WarmupJob
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&job))
+
+	return job
+}
+
+func TestWarmup(t *testing.T) {
+	src := encodeTestJPEG(t, 200, 100)
+	var calls atomic.Int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if r.URL.Path != "/img.jpg" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(src)
+	}))
+	defer origin.Close()
+
+	conf := config.Default()
+	conf.Image.Presets = map[string]string{"thumb": "w=50&h=50"}
+	a := newTestApp(t, conf)
+
+	body := `{"urls": ["` + origin.URL + `/img.jpg", "` + origin.URL + `/missing.jpg"],` +
+		`"sizes": ["w=80&h=0&fmt=png"], "presets": ["thumb"]}`
+	rec := postWarmup(a, body)
+	require.Equal(t, http.StatusAccepted, rec.Code, rec.Body.String())
+
+	var accepted WarmupJob
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&accepted))
+	require.NotEmpty(t, accepted.ID)
+	require.Equal(t, "/warmup/"+accepted.ID, rec.Header().Get("Location"))
+	require.Equal(t, 4, accepted.Total)
+
+	a.wg.Wait()
+
+	job := warmupStatus(t, a, accepted.ID)
+	require.Equal(t, WarmupDone, job.Status)
+	require.NotNil(t, job.Finished)
+	require.Equal(t, 4, job.Done)
+	require.Equal(t, 2, job.Failed)
+	require.Len(t, job.Items, 4)
+	for _, item := range job.Items {
+		if strings.HasSuffix(item.URL, "/img.jpg") {
+			require.Equal(t, WarmupDone, item.Status, item.Error)
+			continue
+		}
+		require.Equal(t, WarmupFailed, item.Status)
+		require.Contains(t, item.Error, "404")
+	}
+
+	// The previews are served from the cache without another source request.
+	callsBefore := calls.Load()
+	rec = doPreview(a, previewPath(50, 50, origin, "/img.jpg"))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "HIT", rec.Header().Get(cacheStatusHeader))
+
+	rec = httptest.NewRecorder()
+	a.GetPreview(rec, httptest.NewRequest(http.MethodGet, "/preview?w=80&fmt=png&url="+origin.URL+"/img.jpg", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "HIT", rec.Header().Get(cacheStatusHeader))
+	require.Equal(t, callsBefore, calls.Load())
+
+	// Warming up again only checks the cache.
+	rec = postWarmup(a, `{"urls": ["`+origin.URL+`/img.jpg"], "presets": ["thumb"]}`)
+	require.Equal(t, http.StatusAccepted, rec.Code)
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&accepted))
+	a.wg.Wait()
+
+	job = warmupStatus(t, a, accepted.ID)
+	require.Equal(t, WarmupCached, job.Items[0].Status)
+	require.Equal(t, callsBefore, calls.Load())
+}
+
+func TestWarmupBadRequest(t *testing.T) {
+	conf := config.Default()
+	conf.Image.Presets = map[string]string{"thumb": "w=50&h=50"}
+	a := newTestApp(t, conf)
+
+	for _, body := range []string{
+		`not json`,
+		`{"urls": [], "presets": ["thumb"]}`,
+		`{"urls": ["example.com/a.jpg"]}`,
+		`{"urls": ["example.com/a.jpg"], "presets": ["unknown"]}`,
+		`{"urls": ["example.com/a.jpg"], "sizes": ["w=abc"]}`,
+		`{"urls": ["example.com/a.jpg"], "sizes": ["w=1&dpr=x"]}`,
+	} {
+		rec := postWarmup(a, body)
+		require.Equal(t, http.StatusBadRequest, rec.Code, body)
+	}
+
+	urls := make([]string, maxWarmupItems+1)
+	for i := range urls {
+		urls[i] = `"example.com/a.jpg"`
+	}
+	rec := postWarmup(a, `{"urls": [`+strings.Join(urls, ",")+`], "presets": ["thumb"]}`)
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = postWarmup(a, `{"urls": ["example.com/`+strings.Repeat("a", maxWarmupBody)+`.jpg"], "presets": ["thumb"]}`)
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+
+	req := httptest.NewRequest(http.MethodGet, "/warmup/unknown", nil)
+	req.SetPathValue("id", "unknown")
+	rec = httptest.NewRecorder()
+	a.WarmupStatus(rec, req)
+	require.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestWarmupLimit(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer origin.Close()
+
+	a := newTestApp(t, config.Default())
+	body := `{"urls": ["` + origin.URL + `/a.jpg", "` + origin.URL + `/b.jpg"], "sizes": ["w=50&h=50"]}`
+
+	ids := make([]string, 0, maxActiveWarmups)
+	for range maxActiveWarmups {
+		rec := postWarmup(a, body)
+		require.Equal(t, http.StatusAccepted, rec.Code)
+
+		var job WarmupJob
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&job))
+		ids = append(ids, job.ID)
+	}
+
+	rec := postWarmup(a, body)
+	require.Equal(t, http.StatusServiceUnavailable, rec.Code)
+
+	// Closing the app cancels the source requests of the running jobs.
+	a.Close()
+	for _, id := range ids {
+		job := warmupStatus(t, a, id)
+		require.Equal(t, WarmupDone, job.Status)
+		require.Equal(t, 2, job.Failed)
+	}
+
+	require.Zero(t, a.warmups.active)
+}
+
+func TestWarmupOverloaded(t *testing.T) {
+	src := encodeTestJPEG(t, 100, 100)
+	var calls atomic.Int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		calls.Add(1)
+		w.Write(src)
+	}))
+	defer origin.Close()
+
+	conf := config.Default()
+	conf.Processing = config.ProcessingConfig{Concurrency: 1, QueueSize: 0, RetryAfter: time.Millisecond}
+	a := newTestApp(t, conf)
+	a.pool.admitted <- struct{}{}
+
+	rec := postWarmup(a, `{"urls": ["`+origin.URL+`/img.jpg"], "sizes": ["w=50&h=50"]}`)
+	require.Equal(t, http.StatusAccepted, rec.Code)
+
+	var accepted WarmupJob
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&accepted))
+
+	// The source is not downloaded while the queue is full.
+	time.Sleep(50 * time.Millisecond)
+	require.Zero(t, calls.Load())
+
+	<-a.pool.admitted
+	a.wg.Wait()
+
+	job := warmupStatus(t, a, accepted.ID)
+	require.Equal(t, WarmupDone, job.Items[0].Status, job.Items[0].Error)
+	require.Equal(t, int32(1), calls.Load())
+}
+
+// panickingCache fails every lookup with a panic.
+type panickingCache struct {
+	Cache
+}
+
+func (panickingCache) Lookup(string) (image.Image, time.Time, bool) {
+	panic("lookup failed")
+}
+
+func TestWarmupPanic(t *testing.T) {
+	a := newTestApp(t, config.Default())
+	a.Cache = panickingCache{a.Cache}
+
+	rec := postWarmup(a, `{"urls": ["example.com/a.jpg"], "sizes": ["w=50&h=50"]}`)
+	require.Equal(t, http.StatusAccepted, rec.Code)
+
+	var accepted WarmupJob
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&accepted))
+	a.wg.Wait()
+
+	job := warmupStatus(t, a, accepted.ID)
+	require.Equal(t, WarmupDone, job.Status)
+	require.NotNil(t, job.Finished)
+	require.Zero(t, a.warmups.active)
+}
+
+func TestNewInvalidPreset(t *testing.T) {
+	conf := config.Default()
+	conf.Image.Presets = map[string]string{"broken": "w=abc"}
+
+	_, err := New(nil, nil, &conf)
+	require.ErrorContains(t, err, "invalid preset broken")
+}
@@ -0,0 +1,117 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"os"
+	"slices"
+
+	"github.com/heltirj/image_previewer/internal/config"
+	"github.com/heltirj/image_previewer/internal/imagetransformer"
+)
+
+const (
+	watermarkParam = "wm"
+	noWatermark    = "none"
+)
+
+// loadWatermarks prepares the configured watermarks once, so that requests only
+// composite them.
+func loadWatermarks(conf map[string]config.WatermarkConfig) (map[string]*imagetransformer.Overlay, error) {
+	watermarks := make(map[string]*imagetransformer.Overlay, len(conf))
+	for name, wm := range conf {
+		overlay, err := newOverlay(name, wm)
+		if err != nil {
+			return nil, fmt.Errorf("invalid watermark %q: %w", name, err)
+		}
+		watermarks[name] = overlay
+	}
+
+	return watermarks, nil
+}
+
+func newOverlay(name string, conf config.WatermarkConfig) (*imagetransformer.Overlay, error) {
+	if name == noWatermark {
+		return nil, fmt.Errorf("%q is reserved", noWatermark)
+	}
+
+	overlay := &imagetransformer.Overlay{
+		Name:     name,
+		Text:     conf.Text,
+		Position: imagetransformer.Position(conf.Position),
+		Scale:    conf.Scale,
+		Opacity:  conf.Opacity,
+		Margin:   conf.Margin,
+	}
+
+	if overlay.Opacity == 0 {
+		overlay.Opacity = 1
+	}
+
+	switch overlay.Position {
+	case "":
+		overlay.Position = imagetransformer.PositionBottomRight
+	case imagetransformer.PositionTopLeft, imagetransformer.PositionTop, imagetransformer.PositionTopRight,
+		imagetransformer.PositionLeft, imagetransformer.PositionCenter, imagetransformer.PositionRight,
+		imagetransformer.PositionBottomLeft, imagetransformer.PositionBottom, imagetransformer.PositionBottomRight:
+	default:
+		return nil, fmt.Errorf("unsupported position: %s", conf.Position)
+	}
+
+	if conf.Color != "" {
+		c, err := parseHexColor(conf.Color)
+		if err != nil {
+			return nil, err
+		}
+		overlay.Color = c
+	}
+
+	if conf.Image == "" {
+		if conf.Text == "" {
+			return nil, errors.New("image or text is required")
+		}
+		return overlay, nil
+	}
+
+	file, err := os.Open(conf.Image)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open image: %w", err)
+	}
+	defer file.Close()
+
+	overlay.Image, _, err = image.Decode(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image: %w", err)
+	}
+
+	return overlay, nil
+}
+
+// applyWatermark appends the watermark chosen by the request, or else by the host or
+// server default, to the operations of opts. An enforced watermark cannot be changed or
+// removed by the request.
+func (a *App) applyWatermark(opts Options, host string) (Options, error) {
+	name := a.hosts[host].Watermark
+	if name == "" {
+		name = a.images.Watermark
+	}
+
+	enforced := a.hosts[host].WatermarkEnforce || a.images.WatermarkEnforce
+	if opts.Watermark != "" && !enforced {
+		name = opts.Watermark
+	}
+
+	if name == "" || name == noWatermark {
+		return opts, nil
+	}
+
+	overlay, ok := a.watermarks[name]
+	if !ok {
+		return Options{}, fmt.Errorf("unknown watermark: %s", name)
+	}
+
+	opts.Operations = append(slices.Clip(opts.Operations), overlay)
+
+	return opts, nil
+}
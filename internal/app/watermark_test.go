@@ -0,0 +1,153 @@
+package app
+
+import (
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/heltirj/image_previewer/internal/cache"
+	"github.com/heltirj/image_previewer/internal/config"
+	"github.com/heltirj/image_previewer/internal/logger"
+	"github.com/stretchr/testify/require"
+)
+
+func writeTestPNG(t *testing.T, c color.Color) string {
+	t.Helper()
+
+	img := image.NewRGBA(image.Rect(0, 0, 10, 10))
+	for i := 0; i < 100; i++ {
+		img.Set(i%10, i/10, c)
+	}
+
+	path := filepath.Join(t.TempDir(), "watermark.png")
+	file, err := os.Create(path)
+	require.NoError(t, err)
+	defer file.Close()
+
+	require.NoError(t, png.Encode(file, img))
+
+	return path
+}
+
+func TestWatermark(t *testing.T) {
+	src := encodeTestJPEG(t, 100, 100)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Write(src)
+	}))
+	defer origin.Close()
+
+	watermarks := map[string]config.WatermarkConfig{
+		"logo":      {Image: writeTestPNG(t, color.RGBA{R: 255, A: 255}), Scale: 0.5},
+		"copyright": {Text: "(c)", Position: "top-left"},
+	}
+
+	withHost := config.Default()
+	withHost.Watermarks = watermarks
+	withHost.Hosts = map[string]config.HostConfig{"127.0.0.1": {Watermark: "logo"}}
+
+	withoutHost := config.Default()
+	withoutHost.Watermarks = watermarks
+
+	enforcedByHost := withHost
+	enforcedByHost.Hosts = map[string]config.HostConfig{"127.0.0.1": {Watermark: "logo", WatermarkEnforce: true}}
+
+	enforced := withoutHost
+	enforced.Image.Watermark = "logo"
+	enforced.Image.WatermarkEnforce = true
+
+	tests := []struct {
+		name          string
+		conf          config.Config
+		query         string
+		wantWatermark bool
+	}{
+		{"no watermark", withoutHost, "", false},
+		{"requested", withoutHost, "wm=logo", true},
+		{"host default", withHost, "", true},
+		{"disabled by request", withHost, "wm=none", false},
+		{"enforced by host", enforcedByHost, "wm=none", true},
+		{"enforced by config", enforced, "wm=none", true},
+		{"replacement ignored", enforced, "wm=copyright", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := doPreview(newTestApp(t, tt.conf), previewQuery(80, 80, origin, "/img.jpg", tt.query))
+			require.Equal(t, http.StatusOK, rec.Code)
+			require.Equal(t, "MISS", rec.Header().Get(cacheStatusHeader))
+
+			img, _, err := image.Decode(rec.Body)
+			require.NoError(t, err)
+
+			r, _, b, _ := img.At(60, 60).RGBA()
+			if tt.wantWatermark {
+				require.Greater(t, r, uint32(0xe000))
+				require.Less(t, b, uint32(0x2000))
+			} else {
+				require.Greater(t, b, uint32(0xe000))
+			}
+		})
+	}
+
+	t.Run("cached separately", func(t *testing.T) {
+		a := newTestApp(t, withoutHost)
+		cacheStatus := func(query string) string {
+			return doPreview(a, previewQuery(80, 80, origin, "/img.jpg", query)).Header().Get(cacheStatusHeader)
+		}
+
+		require.Equal(t, "MISS", cacheStatus(""))
+		require.Equal(t, "MISS", cacheStatus("wm=logo"))
+		require.Equal(t, "HIT", cacheStatus("wm=logo"))
+	})
+
+	t.Run("text", func(t *testing.T) {
+		rec := doPreview(newTestApp(t, withoutHost), previewQuery(80, 80, origin, "/img.jpg", "wm=copyright"))
+		require.Equal(t, http.StatusOK, rec.Code)
+	})
+
+	t.Run("unknown watermark", func(t *testing.T) {
+		rec := doPreview(newTestApp(t, withoutHost), previewQuery(80, 80, origin, "/img.jpg", "wm=missing"))
+		require.Equal(t, http.StatusBadRequest, rec.Code)
+	})
+}
+
+func TestNewWatermarkErrors(t *testing.T) {
+	logg := logger.New(logger.LogLevelError)
+
+	tests := []struct {
+		name   string
+		modify func(conf *config.Config)
+	}{
+		{"unknown default", func(conf *config.Config) { conf.Image.Watermark = "missing" }},
+		{"unknown host watermark", func(conf *config.Config) {
+			conf.Hosts = map[string]config.HostConfig{"example.com": {Watermark: "missing"}}
+		}},
+		{"empty watermark", func(conf *config.Config) {
+			conf.Watermarks = map[string]config.WatermarkConfig{"empty": {}}
+		}},
+		{"missing image", func(conf *config.Config) {
+			conf.Watermarks = map[string]config.WatermarkConfig{"logo": {Image: filepath.Join(t.TempDir(), "missing.png")}}
+		}},
+		{"invalid position", func(conf *config.Config) {
+			conf.Watermarks = map[string]config.WatermarkConfig{"text": {Text: "(c)", Position: "somewhere"}}
+		}},
+		{"reserved name", func(conf *config.Config) {
+			conf.Watermarks = map[string]config.WatermarkConfig{noWatermark: {Text: "(c)"}}
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := config.Default()
+			tt.modify(&conf)
+
+			_, err := New(logg, cache.NewLruImageCache(1, t.TempDir()), &conf)
+			require.Error(t, err)
+		})
+	}
+}
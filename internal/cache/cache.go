@@ -3,16 +3,23 @@ package cache
 import (
 	"fmt"
 	"image"
+	"image/gif"
 	"image/jpeg"
+	"image/png"
+	"io"
 	"os"
 	"path"
 	"path/filepath"
 	"sync"
+	"time"
+
+	"github.com/heltirj/image_previewer/internal/imagetransformer"
 )
 
 type kvPair struct {
-	key   string
-	value image.Image
+	key     string
+	value   image.Image
+	savedAt time.Time
 }
 
 type LruImageCache struct {
@@ -36,52 +43,69 @@ func NewLruImageCache(capacity int, dirPath string) *LruImageCache {
 func (l *LruImageCache) Save(fileName string, img image.Image) error {
 	l.m.Lock()
 	defer l.m.Unlock()
-	item, ok := l.items[fileName]
-	if ok {
-		item.Value = kvPair{key: fileName, value: img}
-		l.items[fileName] = item
-		l.queue.MoveToFront(item)
-		return nil
-	}
 
-	if l.queue.Len() == l.capacity {
-		last := l.queue.Back()
-		l.queue.Remove(last)
-		removeKey := last.Value.(kvPair).key
-		err := os.Remove(path.Join(l.dirPath, removeKey))
-		if err != nil {
-			return fmt.Errorf("failed to remove image from storage: %w", err)
-		}
+	return l.save(fileName, img, time.Now())
+}
 
-		delete(l.items, last.Value.(kvPair).key)
+func (l *LruImageCache) save(fileName string, img image.Image, savedAt time.Time) error {
+	if err := l.evict(fileName); err != nil {
+		return err
 	}
 
-	file, err := os.Create(path.Join(l.dirPath, fileName))
-	if err != nil {
-		return fmt.Errorf("failed to save image to storage: %w", err)
+	if err := l.writeFile(fileName, img, savedAt); err != nil {
+		return err
 	}
 
-	defer file.Close()
+	l.put(fileName, img, savedAt)
 
-	err = jpeg.Encode(file, img, nil)
+	return nil
+}
+
+// evict frees a slot for fileName unless it is already cached.
+func (l *LruImageCache) evict(fileName string) error {
+	if _, ok := l.items[fileName]; ok || l.queue.Len() < l.capacity {
+		return nil
+	}
+
+	last := l.queue.Back()
+	l.queue.Remove(last)
+	removeKey := last.Value.(kvPair).key
+	err := os.Remove(path.Join(l.dirPath, removeKey))
 	if err != nil {
-		return fmt.Errorf("failed to save image to storage: %w", err)
+		return fmt.Errorf("failed to remove image from storage: %w", err)
 	}
 
-	newItem := kvPair{key: fileName, value: img}
-	l.items[fileName] = l.queue.PushFront(newItem)
+	delete(l.items, removeKey)
 
 	return nil
 }
 
+func (l *LruImageCache) put(fileName string, img image.Image, savedAt time.Time) {
+	newItem := kvPair{key: fileName, value: img, savedAt: savedAt}
+	if item, ok := l.items[fileName]; ok {
+		item.Value = newItem
+		l.queue.MoveToFront(item)
+		return
+	}
+
+	l.items[fileName] = l.queue.PushFront(newItem)
+}
+
 func (l *LruImageCache) Get(fileName string) image.Image {
-	l.m.RLock()
-	defer l.m.RUnlock()
+	img, _, _ := l.Lookup(fileName)
+	return img
+}
+
+// Lookup returns the cached image together with the time it was saved.
+func (l *LruImageCache) Lookup(fileName string) (image.Image, time.Time, bool) {
+	l.m.Lock()
+	defer l.m.Unlock()
 	if item, ok := l.items[fileName]; ok {
 		l.queue.MoveToFront(item)
-		return item.Value.(kvPair).value
+		pair := item.Value.(kvPair)
+		return pair.value, pair.savedAt, true
 	}
-	return nil
+	return nil, time.Time{}, false
 }
 
 func (l *LruImageCache) Load() error {
@@ -140,15 +164,87 @@ func (l *LruImageCache) Clear() error {
 	return nil
 }
 
+func (l *LruImageCache) writeFile(fileName string, img image.Image, savedAt time.Time) error {
+	filePath := path.Join(l.dirPath, fileName)
+	file, err := os.Create(filePath)
+	if err != nil {
+		return fmt.Errorf("failed to save image to storage: %w", err)
+	}
+
+	err = encode(file, fileName, img)
+	file.Close()
+	if err != nil {
+		return fmt.Errorf("failed to save image to storage: %w", err)
+	}
+
+	if err = os.Chtimes(filePath, savedAt, savedAt); err != nil {
+		return fmt.Errorf("failed to save image to storage: %w", err)
+	}
+
+	return nil
+}
+
 func (l *LruImageCache) loadFileToStorage(filename string) error {
 	f, err := os.Open(path.Join(l.dirPath, filename))
 	if err != nil {
 		return fmt.Errorf("failed to open image file: %w", err)
 	}
+	defer f.Close()
 
-	if img, err := jpeg.Decode(f); err == nil {
-		return l.Save(filename, img)
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat image file: %w", err)
+	}
+
+	img, err := decode(f, filename)
+	if err != nil {
+		return nil
 	}
 
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	if err := l.evict(filename); err != nil {
+		return err
+	}
+
+	l.put(filename, img, info.ModTime())
+
 	return nil
 }
+
+// encode stores the image in the format given by the file extension, so that formats
+// with transparency or palettes survive a restart.
+func encode(w io.Writer, fileName string, img image.Image) error {
+	switch filepath.Ext(fileName) {
+	case ".png":
+		return png.Encode(w, img)
+	case ".gif":
+		if animation, ok := img.(*imagetransformer.Animation); ok {
+			return gif.EncodeAll(w, animation.GIF)
+		}
+		return gif.Encode(w, img, nil)
+	default:
+		return jpeg.Encode(w, img, nil)
+	}
+}
+
+// decode reads an image written by encode; GIF files with several frames are loaded
+// as animations.
+func decode(r io.Reader, fileName string) (image.Image, error) {
+	if filepath.Ext(fileName) != ".gif" {
+		img, _, err := image.Decode(r)
+		return img, err
+	}
+
+	g, err := gif.DecodeAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(g.Image) > 1 {
+		return &imagetransformer.Animation{GIF: g}, nil
+	}
+
+	return g.Image[0], nil
+}
@@ -3,8 +3,12 @@ package cache
 import (
 	"image"
 	"image/color"
+	"image/gif"
 	"os"
 	"testing"
+	"time"
+
+	"github.com/heltirj/image_previewer/internal/imagetransformer"
 )
 
 func createTestImage() image.Image {
@@ -133,3 +137,116 @@ func TestLruImageCache_LoadError(t *testing.T) {
 		t.Errorf("Expected no error when loading from empty directory, got: %v", err)
 	}
 }
+
+func TestLruImageCache_Lookup(t *testing.T) {
+	dir, err := os.MkdirTemp("", "cache_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	cache := NewLruImageCache(2, dir)
+
+	if _, _, ok := cache.Lookup("image.jpg"); ok {
+		t.Error("Expected no entry for image.jpg before saving")
+	}
+
+	before := time.Now()
+	err = cache.Save("image.jpg", createTestImage())
+	if err != nil {
+		t.Errorf("Expected no error while saving, got: %v", err)
+	}
+
+	img, savedAt, ok := cache.Lookup("image.jpg")
+	if !ok || img == nil {
+		t.Fatal("Expected to retrieve image.jpg, got nothing")
+	}
+	if savedAt.Before(before) {
+		t.Errorf("Expected saved time after %v, got %v", before, savedAt)
+	}
+
+	cache2 := NewLruImageCache(2, dir)
+	err = cache2.Load()
+	if err != nil {
+		t.Errorf("Expected no error while loading, got: %v", err)
+	}
+
+	_, loadedAt, ok := cache2.Lookup("image.jpg")
+	if !ok {
+		t.Fatal("Expected to retrieve image.jpg after loading, got nothing")
+	}
+	if loadedAt.Sub(savedAt).Abs() > time.Second {
+		t.Errorf("Expected saved time %v to survive reload, got %v", savedAt, loadedAt)
+	}
+}
+
+func TestLruImageCache_Formats(t *testing.T) {
+	dir, err := os.MkdirTemp("", "cache_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	cache := NewLruImageCache(3, dir)
+
+	img := image.NewNRGBA(image.Rect(0, 0, 10, 10))
+	img.Set(5, 5, color.NRGBA{255, 0, 0, 128})
+
+	for _, name := range []string{"image.jpg", "image.png", "image.gif"} {
+		if err := cache.Save(name, img); err != nil {
+			t.Errorf("Expected no error while saving %s, got: %v", name, err)
+		}
+	}
+
+	cache2 := NewLruImageCache(3, dir)
+	if err := cache2.Load(); err != nil {
+		t.Errorf("Expected no error while loading, got: %v", err)
+	}
+
+	for _, name := range []string{"image.jpg", "image.png", "image.gif"} {
+		if cache2.Get(name) == nil {
+			t.Errorf("Expected to retrieve %s after loading, got nil", name)
+		}
+	}
+
+	_, _, _, a := cache2.Get("image.png").At(5, 5).RGBA()
+	if a>>8 != 128 {
+		t.Errorf("Expected png to keep transparency, got alpha %d", a>>8)
+	}
+}
+
+func TestLruImageCache_Animation(t *testing.T) {
+	dir, err := os.MkdirTemp("", "cache_test")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	palette := color.Palette{color.Black, color.White}
+	animation := &imagetransformer.Animation{GIF: &gif.GIF{
+		Image: []*image.Paletted{
+			image.NewPaletted(image.Rect(0, 0, 10, 10), palette),
+			image.NewPaletted(image.Rect(0, 0, 10, 10), palette),
+		},
+		Delay: []int{10, 20},
+	}}
+
+	cache := NewLruImageCache(3, dir)
+	if err := cache.Save("animation.gif", animation); err != nil {
+		t.Fatalf("Expected no error while saving, got: %v", err)
+	}
+
+	cache2 := NewLruImageCache(3, dir)
+	if err := cache2.Load(); err != nil {
+		t.Fatalf("Expected no error while loading, got: %v", err)
+	}
+
+	loaded, ok := cache2.Get("animation.gif").(*imagetransformer.Animation)
+	if !ok {
+		t.Fatalf("Expected animation after loading, got %T", cache2.Get("animation.gif"))
+	}
+
+	if len(loaded.GIF.Image) != 2 || loaded.GIF.Delay[1] != 20 {
+		t.Errorf("Expected 2 frames with delays, got %d frames and %v", len(loaded.GIF.Image), loaded.GIF.Delay)
+	}
+}
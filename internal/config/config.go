@@ -3,16 +3,164 @@ package config
 import (
 	"io"
 	"os"
+	"time"
 
 	"github.com/heltirj/image_previewer/internal/logger"
 	"gopkg.in/yaml.v3"
 )
 
 type Config struct {
-	LogLevel    logger.LogLevel `yaml:"logLevel"`
-	StoragePath string          `yaml:"storagePath"`
-	LRUSize     int             `yaml:"lruSize"`
-	Port        int             `yaml:"port"`
+	LogLevel    logger.LogLevel            `yaml:"logLevel"`
+	StoragePath string                     `yaml:"storagePath"`
+	LRUSize     int                        `yaml:"lruSize"`
+	Port        int                        `yaml:"port"`
+	Fetch       FetchConfig                `yaml:"fetch"`
+	Hosts       map[string]HostConfig      `yaml:"hosts"`
+	Cache       CacheConfig                `yaml:"cache"`
+	Fallback    FallbackConfig             `yaml:"fallback"`
+	Compat      CompatConfig               `yaml:"compat"`
+	Image       ImageConfig                `yaml:"image"`
+	Watermarks  map[string]WatermarkConfig `yaml:"watermarks"`
+	Processing  ProcessingConfig           `yaml:"processing"`
+}
+
+// ProcessingConfig limits decoding and resizing, which take most of the CPU and memory.
+// Zero Concurrency means the number of CPUs.
+type ProcessingConfig struct {
+	Concurrency int           `yaml:"concurrency"`
+	QueueSize   int           `yaml:"queueSize"`
+	RetryAfter  time.Duration `yaml:"retryAfter"`
+}
+
+type WatermarkConfig struct {
+	Image    string  `yaml:"image"`
+	Text     string  `yaml:"text"`
+	Color    string  `yaml:"color"`
+	Position string  `yaml:"position"`
+	Scale    float64 `yaml:"scale"`
+	Opacity  float64 `yaml:"opacity"`
+	Margin   int     `yaml:"margin"`
+}
+
+type ImageConfig struct {
+	Enlarge   bool    `yaml:"enlarge"`
+	MaxDPR    float64 `yaml:"maxDPR"`
+	MaxWidth  int     `yaml:"maxWidth"`
+	MaxHeight int     `yaml:"maxHeight"`
+	Watermark string  `yaml:"watermark"`
+	// WatermarkEnforce ignores the wm parameter of requests, so that every preview gets the
+	// configured watermark.
+	WatermarkEnforce bool `yaml:"watermarkEnforce"`
+	MaxFrames        int  `yaml:"maxFrames"`
+	// MaxSourcePixels limits the pixels of a source, and of all the frames of an
+	// animation together, so that decoding it cannot exhaust memory.
+	MaxSourcePixels int `yaml:"maxSourcePixels"`
+	// Background is the rrggbb color transparent images are flattened onto for JPEG.
+	Background string `yaml:"background"`
+	// Presets are named /preview parameters, e.g. w=300&h=200&mode=fit, for warmup.
+	Presets map[string]string `yaml:"presets"`
+}
+
+type CompatConfig struct {
+	Thumbor  bool `yaml:"thumbor"`
+	Imgproxy bool `yaml:"imgproxy"`
+}
+
+type FallbackConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	Image   string `yaml:"image"`
+	Color   string `yaml:"color"`
+}
+
+type CacheConfig struct {
+	TTL                  time.Duration `yaml:"ttl"`
+	StaleWhileRevalidate time.Duration `yaml:"staleWhileRevalidate"`
+	StaleIfError         time.Duration `yaml:"staleIfError"`
+}
+
+type FetchConfig struct {
+	ConnectTimeout time.Duration `yaml:"connectTimeout"`
+	HeaderTimeout  time.Duration `yaml:"headerTimeout"`
+	Timeout        time.Duration `yaml:"timeout"`
+	MaxSourceBytes int64         `yaml:"maxSourceBytes"`
+	ForwardHeaders []string      `yaml:"forwardHeaders"`
+	UserAgent      string        `yaml:"userAgent"`
+	DefaultScheme  string        `yaml:"defaultScheme"`
+	Retry          RetryConfig   `yaml:"retry"`
+	Breaker        BreakerConfig `yaml:"breaker"`
+}
+
+type RetryConfig struct {
+	Attempts       int           `yaml:"attempts"`
+	InitialBackoff time.Duration `yaml:"initialBackoff"`
+	MaxBackoff     time.Duration `yaml:"maxBackoff"`
+}
+
+type BreakerConfig struct {
+	FailureThreshold int           `yaml:"failureThreshold"`
+	CoolDown         time.Duration `yaml:"coolDown"`
+}
+
+type HostConfig struct {
+	Scheme    string            `yaml:"scheme"`
+	Headers   map[string]string `yaml:"headers"`
+	BasicAuth *BasicAuth        `yaml:"basicAuth"`
+	Watermark string            `yaml:"watermark"`
+	// WatermarkEnforce ignores the wm parameter of requests for the host's images.
+	WatermarkEnforce bool `yaml:"watermarkEnforce"`
+}
+
+type BasicAuth struct {
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+func Default() Config {
+	return Config{
+		LogLevel:    logger.LogLevelInfo,
+		StoragePath: "storage",
+		LRUSize:     500,
+		Port:        8080,
+		Fetch: FetchConfig{
+			ConnectTimeout: time.Second * 5,
+			HeaderTimeout:  time.Second * 10,
+			Timeout:        time.Second * 30,
+			MaxSourceBytes: 20 << 20,
+			ForwardHeaders: []string{"Accept-Language"},
+			UserAgent:      "image_previewer",
+			DefaultScheme:  "https",
+			Retry: RetryConfig{
+				Attempts:       2,
+				InitialBackoff: time.Millisecond * 100,
+				MaxBackoff:     time.Second,
+			},
+			Breaker: BreakerConfig{
+				FailureThreshold: 5,
+				CoolDown:         time.Second * 30,
+			},
+		},
+		Cache: CacheConfig{
+			TTL:                  time.Hour * 24,
+			StaleWhileRevalidate: time.Hour,
+			StaleIfError:         time.Hour * 24 * 7,
+		},
+		Fallback: FallbackConfig{
+			Color: "cccccc",
+		},
+		Image: ImageConfig{
+			Enlarge:         true,
+			MaxDPR:          3,
+			MaxWidth:        4096,
+			MaxHeight:       4096,
+			MaxFrames:       100,
+			MaxSourcePixels: 50_000_000,
+			Background:      "ffffff",
+		},
+		Processing: ProcessingConfig{
+			QueueSize:  64,
+			RetryAfter: time.Second,
+		},
+	}
 }
 
 func NewConfig(filename string) (*Config, error) {
@@ -27,7 +175,7 @@ func NewConfig(filename string) (*Config, error) {
 		return nil, err
 	}
 
-	var config Config
+	config := Default()
 	if err = yaml.Unmarshal(bytes, &config); err != nil {
 		return nil, err
 	}
@@ -0,0 +1,208 @@
+package imagetransformer
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"image/gif"
+
+	"golang.org/x/image/draw"
+)
+
+var (
+	ErrFrameOutOfRange = errors.New("frame is out of range")
+	ErrNoFrames        = errors.New("animation has no frames")
+)
+
+// Animation is an animated GIF whose frames all cover the whole canvas. As an
+// image.Image it is its first frame, so code unaware of animations handles it as a
+// still image.
+type Animation struct {
+	GIF *gif.GIF
+}
+
+func (a *Animation) ColorModel() color.Model {
+	return a.GIF.Image[0].ColorModel()
+}
+
+func (a *Animation) Bounds() image.Rectangle {
+	return a.GIF.Image[0].Bounds()
+}
+
+func (a *Animation) At(x, y int) color.Color {
+	return a.GIF.Image[0].At(x, y)
+}
+
+// TransformAnimation transforms every frame of g keeping the delays and the loop count.
+func TransformAnimation(g *gif.GIF, opts Options) (*Animation, error) {
+	if len(g.Image) == 0 {
+		return nil, ErrNoFrames
+	}
+
+	out := &gif.GIF{
+		Image:     make([]*image.Paletted, 0, len(g.Image)),
+		Delay:     make([]int, 0, len(g.Image)),
+		Disposal:  make([]byte, 0, len(g.Image)),
+		LoopCount: g.LoopCount,
+	}
+
+	err := composeFrames(g, len(g.Image)-1, func(i int, canvas *image.RGBA) error {
+		img, err := transformPooled(canvas, opts)
+		if err != nil {
+			return err
+		}
+
+		out.Image = append(out.Image, quantize(img, framePalette(g, i)))
+		releaseIntermediate(img, canvas)
+		out.Delay = append(out.Delay, frameDelay(g, i))
+		out.Disposal = append(out.Disposal, frameDisposal(g, i))
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Every frame is the complete picture, so a frame only has to be cleared when the
+	// next one has transparent pixels that must not show it.
+	for i := 0; i < len(out.Image)-1; i++ {
+		if hasTransparency(out.Image[i+1]) {
+			out.Disposal[i] = gif.DisposalBackground
+		}
+	}
+
+	bounds := out.Image[0].Bounds()
+	out.Config = image.Config{ColorModel: out.Image[0].Palette, Width: bounds.Dx(), Height: bounds.Dy()}
+
+	return &Animation{GIF: out}, nil
+}
+
+// Frame returns the picture shown at frame n of g.
+func Frame(g *gif.GIF, n int) (image.Image, error) {
+	if n < 0 || n >= len(g.Image) {
+		return nil, ErrFrameOutOfRange
+	}
+
+	var frame image.Image
+	err := composeFrames(g, n, func(i int, canvas *image.RGBA) error {
+		if i == n {
+			frame = canvas
+		}
+		return nil
+	})
+
+	return frame, err
+}
+
+// composeFrames draws frames 0..last of g onto a canvas honoring their disposal methods
+// and calls f with the picture shown at each frame. The canvas is reused, so f must not
+// keep it unless it is the last call.
+func composeFrames(g *gif.GIF, last int, f func(i int, canvas *image.RGBA) error) error {
+	bounds := image.Rect(0, 0, g.Config.Width, g.Config.Height)
+	if bounds.Empty() {
+		for _, frame := range g.Image {
+			bounds = bounds.Union(frame.Bounds())
+		}
+	}
+
+	canvas := newRGBA(bounds)
+	for i, frame := range g.Image[:last+1] {
+		var previous *image.RGBA
+		if frameDisposal(g, i) == gif.DisposalPrevious && i < last {
+			previous = newRGBA(bounds)
+			copy(previous.Pix, canvas.Pix)
+		}
+
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+
+		if err := f(i, canvas); err != nil {
+			return err
+		}
+
+		if i == last {
+			break
+		}
+
+		switch frameDisposal(g, i) {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			putRGBA(canvas)
+			canvas = previous
+		}
+	}
+
+	return nil
+}
+
+// quantize converts img to a paletted frame with the palette of the source frame, adding
+// a transparent color when the palette lacks one.
+func quantize(img image.Image, palette color.Palette) *image.Paletted {
+	if !hasTransparentColor(palette) {
+		if len(palette) < 256 {
+			palette = append(palette[:len(palette):len(palette)], color.Transparent)
+		} else {
+			palette = append(palette[:255:255], color.Transparent)
+		}
+	}
+
+	bounds := img.Bounds()
+	paletted := image.NewPaletted(image.Rect(0, 0, bounds.Dx(), bounds.Dy()), palette)
+	draw.Draw(paletted, paletted.Rect, img, bounds.Min, draw.Src)
+
+	return paletted
+}
+
+func framePalette(g *gif.GIF, i int) color.Palette {
+	if palette := g.Image[i].Palette; len(palette) > 0 {
+		return palette
+	}
+
+	if palette, ok := g.Config.ColorModel.(color.Palette); ok && len(palette) > 0 {
+		return palette
+	}
+
+	return color.Palette{color.Black, color.White}
+}
+
+func frameDelay(g *gif.GIF, i int) int {
+	if i < len(g.Delay) {
+		return g.Delay[i]
+	}
+
+	return 0
+}
+
+func frameDisposal(g *gif.GIF, i int) byte {
+	if i < len(g.Disposal) {
+		return g.Disposal[i]
+	}
+
+	return gif.DisposalNone
+}
+
+func hasTransparentColor(palette color.Palette) bool {
+	for _, c := range palette {
+		if _, _, _, a := c.RGBA(); a == 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+func hasTransparency(img *image.Paletted) bool {
+	transparent := make([]bool, len(img.Palette))
+	for i, c := range img.Palette {
+		_, _, _, a := c.RGBA()
+		transparent[i] = a == 0
+	}
+
+	for _, index := range img.Pix {
+		if int(index) < len(transparent) && transparent[index] {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,125 @@
+package imagetransformer
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"image/gif"
+	"testing"
+)
+
+var (
+	red   = color.RGBA{R: 255, A: 255}
+	blue  = color.RGBA{B: 255, A: 255}
+	green = color.RGBA{G: 255, A: 255}
+)
+
+// testAnimation is a 40x20 red frame followed by a blue left half disposed with the
+// given method and a green right half.
+func testAnimation(disposal byte) *gif.GIF {
+	palette := color.Palette{red, blue, green, color.Transparent}
+	frame := func(rect image.Rectangle, c color.Color) *image.Paletted {
+		img := image.NewPaletted(rect, palette)
+		for i := range img.Pix {
+			img.Pix[i] = uint8(palette.Index(c))
+		}
+		return img
+	}
+
+	return &gif.GIF{
+		Image: []*image.Paletted{
+			frame(image.Rect(0, 0, 40, 20), red),
+			frame(image.Rect(0, 0, 20, 20), blue),
+			frame(image.Rect(20, 0, 40, 20), green),
+		},
+		Delay:     []int{10, 20, 30},
+		Disposal:  []byte{gif.DisposalNone, disposal, gif.DisposalNone},
+		LoopCount: 3,
+		Config:    image.Config{ColorModel: palette, Width: 40, Height: 20},
+	}
+}
+
+func TestFrame(t *testing.T) {
+	tests := []struct {
+		disposal    byte
+		frame       int
+		left, right color.Color
+	}{
+		{gif.DisposalNone, 0, red, red},
+		{gif.DisposalNone, 1, blue, red},
+		{gif.DisposalNone, 2, blue, green},
+		{gif.DisposalBackground, 2, color.RGBA{}, green},
+		{gif.DisposalPrevious, 2, red, green},
+	}
+
+	for _, tt := range tests {
+		img, err := Frame(testAnimation(tt.disposal), tt.frame)
+		if err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+
+		if img.Bounds() != image.Rect(0, 0, 40, 20) {
+			t.Errorf("Expected frame to cover the canvas, got %v", img.Bounds())
+		}
+
+		for x, expected := range map[int]color.Color{5: tt.left, 35: tt.right} {
+			if got := color.RGBAModel.Convert(img.At(x, 5)); got != expected {
+				t.Errorf("Disposal %d, frame %d: expected %v at x=%d, got %v", tt.disposal, tt.frame,
+					expected, x, got)
+			}
+		}
+	}
+
+	if _, err := Frame(testAnimation(gif.DisposalNone), 3); !errors.Is(err, ErrFrameOutOfRange) {
+		t.Errorf("Expected ErrFrameOutOfRange, got: %v", err)
+	}
+}
+
+func TestTransformAnimation(t *testing.T) {
+	anim, err := TransformAnimation(testAnimation(gif.DisposalBackground), Options{
+		Width: 20, Height: 10, Mode: ModeFit, Enlarge: true, Operations: Operations{Flip("h")},
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	g := anim.GIF
+	if len(g.Image) != 3 {
+		t.Fatalf("Expected 3 frames, got %d", len(g.Image))
+	}
+
+	if g.LoopCount != 3 || g.Delay[0] != 10 || g.Delay[1] != 20 || g.Delay[2] != 30 {
+		t.Errorf("Expected loop count and delays to be kept, got %d %v", g.LoopCount, g.Delay)
+	}
+
+	if g.Config.Width != 20 || g.Config.Height != 10 || anim.Bounds() != image.Rect(0, 0, 20, 10) {
+		t.Errorf("Expected 20x10 animation, got %dx%d", g.Config.Width, g.Config.Height)
+	}
+
+	for i, frame := range g.Image {
+		if frame.Bounds() != image.Rect(0, 0, 20, 10) {
+			t.Errorf("Expected frame %d to cover the canvas, got %v", i, frame.Bounds())
+		}
+	}
+
+	// The last frame is transparent on the right after flipping, so the previous one
+	// has to be cleared.
+	if g.Disposal[1] != gif.DisposalBackground {
+		t.Errorf("Expected frame 1 to be disposed to background, got %d", g.Disposal[1])
+	}
+
+	if got := color.RGBAModel.Convert(g.Image[1].At(15, 5)); got != blue {
+		t.Errorf("Expected flipped blue half on the right, got %v", got)
+	}
+
+	if _, _, _, a := g.Image[2].At(15, 5).RGBA(); a != 0 {
+		t.Errorf("Expected transparent right half of the last frame, got alpha %d", a)
+	}
+}
+
+func TestTransformAnimationNoFrames(t *testing.T) {
+	_, err := TransformAnimation(&gif.GIF{}, Options{Width: 20, Height: 10, Mode: ModeFit})
+	if !errors.Is(err, ErrNoFrames) {
+		t.Errorf("Expected ErrNoFrames, got: %v", err)
+	}
+}
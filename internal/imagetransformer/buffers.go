@@ -0,0 +1,99 @@
+package imagetransformer
+
+import (
+	"image"
+	"math/bits"
+	"sync"
+)
+
+// Pixel buffers are pooled by size class, a power of two number of bytes, so that a
+// buffer fits every image of its class. Smaller images share the smallest class and
+// larger ones are not pooled.
+//
+// Only intermediate images are meant to be pooled. A buffer may be up to twice as large
+// as its image, so the images returned to the caller are copied by exact.
+const (
+	minSizeClass = 12 // 4 KiB
+	maxSizeClass = 27 // 128 MiB, more than a 4096x4096 image
+)
+
+var pixPools [maxSizeClass + 1]sync.Pool
+
+// poolBuffers can be turned off to compare against plain allocations.
+var poolBuffers = true
+
+// newRGBA is image.NewRGBA with the pixel buffer taken from the pool.
+func newRGBA(r image.Rectangle) *image.RGBA {
+	n := 4 * r.Dx() * r.Dy()
+	class := sizeClass(n)
+	if !poolBuffers || class > maxSizeClass {
+		return image.NewRGBA(r)
+	}
+
+	var pix []uint8
+	if buf, ok := pixPools[class].Get().(*[]uint8); ok {
+		pix = (*buf)[:n]
+		clear(pix)
+	} else {
+		pix = make([]uint8, n, 1<<class)
+	}
+
+	return &image.RGBA{Pix: pix, Stride: 4 * r.Dx(), Rect: r}
+}
+
+// putRGBA returns the pixel buffer of img to the pool. img must not be used afterwards,
+// its pixels are dropped so that a mistaken use fails loudly.
+func putRGBA(img *image.RGBA) {
+	class := sizeClass(cap(img.Pix))
+	if !poolBuffers || class > maxSizeClass || cap(img.Pix) != 1<<class {
+		return
+	}
+
+	pix := img.Pix[:0]
+	img.Pix = nil
+	pixPools[class].Put(&pix)
+}
+
+// exact returns img with a pixel buffer of its own size, so that a returned image that
+// is kept, e.g. in a cache, does not hold the spare capacity of a pooled buffer. The
+// pooled buffer goes back to the pool.
+func exact(img image.Image) image.Image {
+	rgba, ok := img.(*image.RGBA)
+	if !ok || cap(rgba.Pix) == len(rgba.Pix) {
+		return img
+	}
+
+	dst := image.NewRGBA(rgba.Rect)
+	copy(dst.Pix, rgba.Pix)
+	putRGBA(rgba)
+
+	return dst
+}
+
+// Release gives the pixel buffer of an *image.RGBA, such as a frame returned by Frame,
+// to the pool when its capacity is that of a size class. The image must not be used
+// afterwards; images of other types are left alone.
+func Release(img image.Image) {
+	if rgba, ok := img.(*image.RGBA); ok {
+		putRGBA(rgba)
+	}
+}
+
+// releaseIntermediate releases img unless it is one of the images still in use.
+func releaseIntermediate(img image.Image, inUse ...image.Image) {
+	for _, used := range inUse {
+		if img == used {
+			return
+		}
+	}
+
+	Release(img)
+}
+
+func sizeClass(n int) int {
+	if n <= 1<<minSizeClass {
+		return minSizeClass
+	}
+
+	return bits.Len(uint(n - 1))
+}
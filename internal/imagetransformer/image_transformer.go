@@ -1,34 +1,162 @@
 package imagetransformer
 
 import (
+	"errors"
 	"image"
+	"image/color"
+	"runtime"
+	"sync"
 
 	"golang.org/x/image/draw"
 )
 
-type SubImager interface {
-	SubImage(r image.Rectangle) image.Image
+type Mode string
+
+const (
+	// ModeFill crops the image to the requested aspect ratio and scales it to the exact size.
+	ModeFill Mode = "fill"
+	// ModeFit scales the whole image to fit into the requested size preserving the aspect ratio.
+	ModeFit Mode = "fit"
+	// ModeStretch scales the whole image to the exact size ignoring the aspect ratio.
+	ModeStretch Mode = "stretch"
+)
+
+var ErrInvalidSize = errors.New("width or height must be positive")
+
+// Options describe the output image. Zero width or height is computed from the
+// aspect ratio of the source. Unless Enlarge is set the output is never larger than
+// the source: the requested size is scaled down keeping its aspect ratio.
+type Options struct {
+	Width      int
+	Height     int
+	Mode       Mode
+	Enlarge    bool
+	Operations Operations
+	// MaxWidth and MaxHeight, when positive, limit the output size: a size computed from
+	// the aspect ratio of the source is scaled down to fit into them.
+	MaxWidth  int
+	MaxHeight int
+	// Background, when set, replaces the transparency of the output: the image is
+	// composited onto it. Formats without an alpha channel need it.
+	Background color.Color
+}
+
+func Transform(img image.Image, opts Options) (image.Image, error) {
+	result, err := transformPooled(img, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return exact(result), nil
+}
+
+// transformPooled is Transform whose result may be in a pooled buffer, for callers that
+// release it right away.
+func transformPooled(img image.Image, opts Options) (image.Image, error) {
+	orientation, filters := splitOperations(opts.Operations)
+
+	// Every image but the source and the result is released for reuse.
+	oriented := applyOperations(img, orientation)
+	resized, err := transform(oriented, opts)
+	releaseIntermediate(oriented, img)
+	if err != nil {
+		return nil, err
+	}
+
+	result := applyOperations(resized, filters)
+	releaseIntermediate(resized, result)
+
+	if opts.Background != nil {
+		flat := Flatten(result, opts.Background)
+		releaseIntermediate(result, flat)
+		result = flat
+	}
+
+	return result, nil
+}
+
+// Flatten composites img onto an opaque background; opaque images are returned as is.
+func Flatten(img image.Image, bg color.Color) image.Image {
+	if opaque, ok := img.(interface{ Opaque() bool }); ok && opaque.Opaque() {
+		return img
+	}
+
+	b := img.Bounds()
+	dst := newRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(dst, dst.Rect, image.NewUniform(bg), image.Point{}, draw.Src)
+	draw.Draw(dst, dst.Rect, img, b.Min, draw.Over)
+
+	return dst
+}
+
+func transform(img image.Image, opts Options) (image.Image, error) {
+	srcWidth, srcHeight := img.Bounds().Dx(), img.Bounds().Dy()
+
+	var err error
+	opts.Width, opts.Height, err = getAutoSizes(srcWidth, srcHeight, opts.Width, opts.Height)
+	if err != nil {
+		return nil, err
+	}
+	opts.Width, opts.Height = getLimitedSizes(opts.Width, opts.Height, opts.MaxWidth, opts.MaxHeight)
+
+	switch opts.Mode {
+	case ModeFit:
+		width, height := getFitSizes(srcWidth, srcHeight, opts.Width, opts.Height)
+		if !opts.Enlarge && (width > srcWidth || height > srcHeight) {
+			width, height = srcWidth, srcHeight
+		}
+		return scale(img, width, height), nil
+	case ModeStretch:
+		if !opts.Enlarge {
+			opts.Width, opts.Height = min(opts.Width, srcWidth), min(opts.Height, srcHeight)
+		}
+		return scale(img, opts.Width, opts.Height), nil
+	case ModeFill:
+		return fill(img, opts)
+	default:
+		return fill(img, opts)
+	}
+}
+
+func fill(img image.Image, opts Options) (image.Image, error) {
+	if !opts.Enlarge {
+		opts.Width, opts.Height = getCappedSizes(img.Bounds().Dx(), img.Bounds().Dy(), opts.Width, opts.Height)
+	}
+
+	return resize(img, opts.Width, opts.Height)
 }
 
 func Resize(img image.Image, width, height int) (image.Image, error) {
-	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	resized, err := resize(img, width, height)
+	if err != nil {
+		return nil, err
+	}
+
+	return exact(resized), nil
+}
+
+func resize(img image.Image, width, height int) (image.Image, error) {
+	width, height, err := getAutoSizes(img.Bounds().Dx(), img.Bounds().Dy(), width, height)
+	if err != nil {
+		return nil, err
+	}
 
-	cropped := crop(img, width, height)
+	dst := newRGBA(image.Rect(0, 0, width, height))
 
-	draw.ApproxBiLinear.Scale(dst, dst.Rect, cropped, cropped.Bounds(), draw.Over, nil)
+	scaleTo(dst, img, crop(img.Bounds(), width, height), stripes(width, height))
 
 	return dst, nil
 }
 
-func crop(img image.Image, width, height int) image.Image {
-	croppedWidth, croppedHeight := getCroppedSizes(img.Bounds().Dx(), img.Bounds().Dy(), width, height)
+// crop returns the centered part of bounds with the aspect ratio of width x height. The
+// source is scaled from this rectangle directly, so any image.Image can be cropped.
+func crop(bounds image.Rectangle, width, height int) image.Rectangle {
+	croppedWidth, croppedHeight := getCroppedSizes(bounds.Dx(), bounds.Dy(), width, height)
 
-	x0 := (img.Bounds().Dx() - croppedWidth) / 2
-	y0 := (img.Bounds().Dy() - croppedHeight) / 2
+	x0 := bounds.Min.X + (bounds.Dx()-croppedWidth)/2
+	y0 := bounds.Min.Y + (bounds.Dy()-croppedHeight)/2
 
-	croppedImg := image.Rect(x0, y0, x0+croppedWidth, y0+croppedHeight)
-
-	return img.(SubImager).SubImage(croppedImg)
+	return image.Rect(x0, y0, x0+croppedWidth, y0+croppedHeight)
 }
 
 func getCroppedSizes(srcWidth, srcHeight, dstWidth, dstHeight int) (croppedWidth, croppedHeight int) {
@@ -38,3 +166,105 @@ func getCroppedSizes(srcWidth, srcHeight, dstWidth, dstHeight int) (croppedWidth
 
 	return srcWidth, dstHeight * srcWidth / dstWidth
 }
+
+func scale(img image.Image, width, height int) image.Image {
+	dst := newRGBA(image.Rect(0, 0, width, height))
+
+	scaleTo(dst, img, img.Bounds(), stripes(width, height))
+
+	return dst
+}
+
+const (
+	// minParallelPixels is the output size from which scaling is split across cores;
+	// below it the goroutines cost more than they save.
+	minParallelPixels = 512 * 512
+	// minStripeHeight keeps the stripes tall enough to be worth a goroutine each.
+	minStripeHeight = 64
+)
+
+// stripes returns the number of horizontal stripes a width x height output is scaled in.
+func stripes(width, height int) int {
+	if width*height < minParallelPixels {
+		return 1
+	}
+
+	return max(1, min(runtime.GOMAXPROCS(0), height/minStripeHeight))
+}
+
+// scaleTo scales the sr part of src onto the whole dst. With n > 1 the rows of dst are
+// split into n stripes scaled concurrently. Every stripe is a clip of the same
+// destination rectangle, so the pixels are the same as when scaling it at once.
+func scaleTo(dst *image.RGBA, src image.Image, sr image.Rectangle, n int) {
+	if n <= 1 {
+		draw.ApproxBiLinear.Scale(dst, dst.Rect, src, sr, draw.Src, nil)
+		return
+	}
+
+	var wg sync.WaitGroup
+	height := dst.Rect.Dy()
+	for i := 0; i < n; i++ {
+		stripe := dst.Rect
+		stripe.Min.Y = dst.Rect.Min.Y + height*i/n
+		stripe.Max.Y = dst.Rect.Min.Y + height*(i+1)/n
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			draw.ApproxBiLinear.Scale(dst.SubImage(stripe).(*image.RGBA), dst.Rect, src, sr, draw.Src, nil)
+		}()
+	}
+	wg.Wait()
+}
+
+func getFitSizes(srcWidth, srcHeight, dstWidth, dstHeight int) (width, height int) {
+	if srcWidth*dstHeight > srcHeight*dstWidth {
+		return dstWidth, max(1, (srcHeight*dstWidth+srcWidth/2)/srcWidth)
+	}
+
+	return max(1, (srcWidth*dstHeight+srcHeight/2)/srcHeight), dstHeight
+}
+
+// getAutoSizes fills in a zero dimension so that the output keeps the source aspect ratio.
+func getAutoSizes(srcWidth, srcHeight, dstWidth, dstHeight int) (width, height int, err error) {
+	switch {
+	case dstWidth < 0 || dstHeight < 0 || dstWidth == 0 && dstHeight == 0:
+		return 0, 0, ErrInvalidSize
+	case srcWidth <= 0 || srcHeight <= 0:
+		return dstWidth, dstHeight, nil
+	case dstWidth == 0:
+		return max(1, (srcWidth*dstHeight+srcHeight/2)/srcHeight), dstHeight, nil
+	case dstHeight == 0:
+		return dstWidth, max(1, (srcHeight*dstWidth+srcWidth/2)/srcWidth), nil
+	default:
+		return dstWidth, dstHeight, nil
+	}
+}
+
+// getLimitedSizes scales the size down, keeping its aspect ratio, until it fits into
+// maxWidth x maxHeight; a non-positive limit is not applied.
+func getLimitedSizes(width, height, maxWidth, maxHeight int) (int, int) {
+	if maxWidth > 0 && width > maxWidth {
+		width, height = maxWidth, max(1, (height*maxWidth+width/2)/width)
+	}
+
+	if maxHeight > 0 && height > maxHeight {
+		width, height = max(1, (width*maxHeight+height/2)/height), maxHeight
+	}
+
+	return width, height
+}
+
+// getCappedSizes scales the requested size down, keeping its aspect ratio, until it fits
+// into the source.
+func getCappedSizes(srcWidth, srcHeight, dstWidth, dstHeight int) (width, height int) {
+	if dstWidth <= srcWidth && dstHeight <= srcHeight {
+		return dstWidth, dstHeight
+	}
+
+	if srcWidth*dstHeight < srcHeight*dstWidth {
+		return srcWidth, max(1, (dstHeight*srcWidth+dstWidth/2)/dstWidth)
+	}
+
+	return max(1, (dstWidth*srcHeight+dstHeight/2)/dstHeight), srcHeight
+}
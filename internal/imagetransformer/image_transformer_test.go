@@ -1,11 +1,13 @@
 package imagetransformer
 
 import (
+	"bytes"
 	"image"
 	"image/color"
 	"image/jpeg"
 	"os"
 	"path"
+	"runtime"
 	"strconv"
 	"testing"
 )
@@ -26,10 +28,6 @@ func (ti *testImage) At(_, _ int) color.Color {
 	return color.RGBA{255, 0, 0, 255} // Красный цвет для тестирования
 }
 
-func (ti *testImage) SubImage(r image.Rectangle) image.Image {
-	return &testImage{bounds: r}
-}
-
 func createTestImage(width, height int) image.Image {
 	return &testImage{bounds: image.Rect(0, 0, width, height)}
 }
@@ -99,16 +97,40 @@ func TestGetCroppedSizes(t *testing.T) {
 }
 
 func TestCrop(t *testing.T) {
-	img := createTestImage(100, 100)
+	tests := []struct {
+		bounds   image.Rectangle
+		width    int
+		height   int
+		expected image.Rectangle
+	}{
+		{image.Rect(0, 0, 100, 100), 50, 50, image.Rect(0, 0, 100, 100)},
+		{image.Rect(0, 0, 100, 100), 50, 25, image.Rect(0, 25, 100, 75)},
+		{image.Rect(10, 10, 110, 60), 50, 50, image.Rect(35, 10, 85, 60)},
+	}
+
+	for _, tt := range tests {
+		if cropped := crop(tt.bounds, tt.width, tt.height); cropped != tt.expected {
+			t.Errorf("Expected %v cropped to %dx%d to be %v, got %v", tt.bounds, tt.width, tt.height,
+				tt.expected, cropped)
+		}
+	}
+}
+
+func TestResizeNotSubImager(t *testing.T) {
+	// testImage has no SubImage method and an offset origin.
+	img := &testImage{bounds: image.Rect(-20, 10, 180, 110)}
 
-	croppedImg := crop(img, 50, 50)
-	if croppedImg.Bounds().Dx() != 100 || croppedImg.Bounds().Dy() != 100 {
-		t.Errorf("Expected cropped image dimensions to be 50x50, got: %dx%d", croppedImg.Bounds().Dx(),
-			croppedImg.Bounds().Dy())
+	resized, err := Resize(img, 50, 50)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	if resized.Bounds() != image.Rect(0, 0, 50, 50) {
+		t.Errorf("Expected 50x50 image, got %v", resized.Bounds())
 	}
 
-	if _, ok := croppedImg.(SubImager); !ok {
-		t.Error("Expected cropped image to implement SubImager")
+	if c := color.RGBAModel.Convert(resized.At(25, 25)); c != (color.RGBA{255, 0, 0, 255}) {
+		t.Errorf("Expected source color, got %v", c)
 	}
 }
 
@@ -178,3 +200,411 @@ func TestResizeGopherImage(t *testing.T) {
 		}
 	}
 }
+
+func TestTransformModes(t *testing.T) {
+	tests := []struct {
+		mode           Mode
+		expectedWidth  int
+		expectedHeight int
+	}{
+		{ModeFill, 100, 100},
+		{ModeFit, 100, 50},
+		{ModeStretch, 100, 100},
+		{"", 100, 100},
+	}
+
+	for _, tt := range tests {
+		img, err := Transform(createTestImage(400, 200), Options{Width: 100, Height: 100, Mode: tt.mode, Enlarge: true})
+		if err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+
+		if img.Bounds().Dx() != tt.expectedWidth || img.Bounds().Dy() != tt.expectedHeight {
+			t.Errorf("For mode %q expected %dx%d, got %dx%d", tt.mode, tt.expectedWidth, tt.expectedHeight,
+				img.Bounds().Dx(), img.Bounds().Dy())
+		}
+	}
+}
+
+func TestGetFitSizes(t *testing.T) {
+	tests := []struct {
+		srcWidth, srcHeight, dstWidth, dstHeight int
+		expectedWidth, expectedHeight            int
+	}{
+		{400, 200, 100, 100, 100, 50},
+		{200, 400, 100, 100, 50, 100},
+		{1024, 504, 300, 300, 300, 148},
+		{1000, 1, 10, 10, 10, 1},
+	}
+
+	for _, tt := range tests {
+		width, height := getFitSizes(tt.srcWidth, tt.srcHeight, tt.dstWidth, tt.dstHeight)
+		if width != tt.expectedWidth || height != tt.expectedHeight {
+			t.Errorf("For src %dx%d and box %dx%d expected %dx%d, got %dx%d", tt.srcWidth, tt.srcHeight,
+				tt.dstWidth, tt.dstHeight, tt.expectedWidth, tt.expectedHeight, width, height)
+		}
+	}
+}
+
+func TestGetAutoSizes(t *testing.T) {
+	tests := []struct {
+		srcWidth, srcHeight, dstWidth, dstHeight int
+		expectedWidth, expectedHeight            int
+	}{
+		{1024, 504, 300, 0, 300, 148},
+		{1024, 504, 0, 252, 512, 252},
+		{400, 300, 200, 100, 200, 100},
+		{1000, 1, 10, 0, 10, 1},
+	}
+
+	for _, tt := range tests {
+		width, height, err := getAutoSizes(tt.srcWidth, tt.srcHeight, tt.dstWidth, tt.dstHeight)
+		if err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+
+		if width != tt.expectedWidth || height != tt.expectedHeight {
+			t.Errorf("For src %dx%d and dst %dx%d expected %dx%d, got %dx%d", tt.srcWidth, tt.srcHeight,
+				tt.dstWidth, tt.dstHeight, tt.expectedWidth, tt.expectedHeight, width, height)
+		}
+	}
+
+	for _, size := range [][2]int{{0, 0}, {-1, 100}, {100, -1}} {
+		if _, _, err := getAutoSizes(400, 300, size[0], size[1]); err == nil {
+			t.Errorf("Expected error for %dx%d", size[0], size[1])
+		}
+	}
+}
+
+func TestTransformAutoSize(t *testing.T) {
+	for _, mode := range []Mode{ModeFill, ModeFit, ModeStretch} {
+		img, err := Transform(createTestImage(400, 200), Options{Width: 100, Mode: mode})
+		if err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+
+		if img.Bounds().Dx() != 100 || img.Bounds().Dy() != 50 {
+			t.Errorf("For mode %q expected 100x50, got %dx%d", mode, img.Bounds().Dx(), img.Bounds().Dy())
+		}
+	}
+}
+
+func TestTransformSizeLimit(t *testing.T) {
+	tests := []struct {
+		srcWidth, srcHeight, width, height int
+		mode                               Mode
+		expected                           image.Rectangle
+	}{
+		{10, 2000, 4096, 0, ModeFill, image.Rect(0, 0, 20, 4096)},
+		{10, 2000, 4096, 0, ModeStretch, image.Rect(0, 0, 20, 4096)},
+		{10, 2000, 4096, 0, ModeFit, image.Rect(0, 0, 20, 4000)},
+		{2000, 10, 0, 4096, ModeFill, image.Rect(0, 0, 4096, 20)},
+		{400, 200, 100, 0, ModeFill, image.Rect(0, 0, 100, 50)},
+	}
+
+	for _, tt := range tests {
+		opts := Options{
+			Width: tt.width, Height: tt.height, Mode: tt.mode, Enlarge: true, MaxWidth: 4096, MaxHeight: 4096,
+		}
+		img, err := Transform(createTestImage(tt.srcWidth, tt.srcHeight), opts)
+		if err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+
+		if img.Bounds() != tt.expected {
+			t.Errorf("For %dx%d in mode %q expected %v, got %v", tt.srcWidth, tt.srcHeight, tt.mode,
+				tt.expected, img.Bounds())
+		}
+	}
+}
+
+func TestTransformNoEnlarge(t *testing.T) {
+	tests := []struct {
+		mode                          Mode
+		width, height                 int
+		expectedWidth, expectedHeight int
+	}{
+		{ModeFill, 1000, 1000, 100, 100},
+		{ModeFill, 400, 100, 200, 50},
+		{ModeFill, 100, 200, 50, 100},
+		{ModeFill, 150, 50, 150, 50},
+		{ModeFit, 1000, 1000, 200, 100},
+		{ModeFit, 100, 100, 100, 50},
+		{ModeStretch, 1000, 50, 200, 50},
+		{ModeFill, 1000, 0, 200, 100},
+	}
+
+	for _, tt := range tests {
+		img, err := Transform(createTestImage(200, 100), Options{Width: tt.width, Height: tt.height, Mode: tt.mode})
+		if err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+
+		if img.Bounds().Dx() != tt.expectedWidth || img.Bounds().Dy() != tt.expectedHeight {
+			t.Errorf("For mode %q and %dx%d expected %dx%d, got %dx%d", tt.mode, tt.width, tt.height,
+				tt.expectedWidth, tt.expectedHeight, img.Bounds().Dx(), img.Bounds().Dy())
+		}
+	}
+}
+
+func TestResizeTransparent(t *testing.T) {
+	// Fully transparent red must not bleed into the opaque blue half when interpolating.
+	src := image.NewNRGBA(image.Rect(0, 0, 40, 20))
+	for y := 0; y < 20; y++ {
+		for x := 0; x < 40; x++ {
+			if x < 20 {
+				src.SetNRGBA(x, y, color.NRGBA{R: 255})
+			} else {
+				src.SetNRGBA(x, y, color.NRGBA{B: 255, A: 255})
+			}
+		}
+	}
+
+	img, err := Transform(src, Options{Width: 15, Height: 10, Mode: ModeFit, Enlarge: true})
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	for x := 0; x < 15; x++ {
+		c := color.NRGBAModel.Convert(img.At(x, 5)).(color.NRGBA)
+		if c.A > 0 && c.R > 0 {
+			t.Fatalf("Expected no red at x=%d, got %v", x, c)
+		}
+	}
+
+	if _, _, _, a := img.At(0, 5).RGBA(); a != 0 {
+		t.Errorf("Expected transparency to be kept, got alpha %d", a)
+	}
+
+	flat, err := Transform(src, Options{Width: 15, Height: 10, Mode: ModeFit, Enlarge: true, Background: color.White})
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	if c := color.RGBAModel.Convert(flat.At(0, 5)); c != (color.RGBA{R: 255, G: 255, B: 255, A: 255}) {
+		t.Errorf("Expected white background, got %v", c)
+	}
+
+	if c := color.RGBAModel.Convert(flat.At(14, 5)); c != (color.RGBA{B: 255, A: 255}) {
+		t.Errorf("Expected opaque pixels to be kept, got %v", c)
+	}
+}
+
+func TestBufferPool(t *testing.T) {
+	dirty := newRGBA(image.Rect(0, 0, 40, 30))
+	if cap(dirty.Pix) != 1<<13 {
+		t.Errorf("Expected a buffer of the 8 KiB class, got capacity %d", cap(dirty.Pix))
+	}
+	for i := range dirty.Pix {
+		dirty.Pix[i] = 255
+	}
+	putRGBA(dirty)
+
+	if dirty.Pix != nil {
+		t.Error("Expected released image to drop its pixels")
+	}
+
+	// Whether the buffer is reused or not, it comes cleared and fits the class.
+	img := newRGBA(image.Rect(0, 0, 30, 40))
+	if len(img.Pix) != 30*40*4 || img.Stride != 30*4 || cap(img.Pix) != 1<<13 {
+		t.Fatalf("Expected 30x40 buffer of 8 KiB, got %d bytes of %d with stride %d", len(img.Pix),
+			cap(img.Pix), img.Stride)
+	}
+
+	for i, v := range img.Pix {
+		if v != 0 {
+			t.Fatalf("Expected cleared buffer, got %d at %d", v, i)
+		}
+	}
+
+	// Buffers that are not of a size class are not pooled.
+	other := image.NewRGBA(image.Rect(0, 0, 30, 20))
+	putRGBA(other)
+	if other.Pix == nil {
+		t.Error("Expected a buffer of another size to be left alone")
+	}
+
+	if sizeClass(1) != minSizeClass || sizeClass(4096) != 12 || sizeClass(4097) != 13 {
+		t.Errorf("Unexpected size classes %d %d %d", sizeClass(1), sizeClass(4096), sizeClass(4097))
+	}
+}
+
+func TestTransformExactBuffer(t *testing.T) {
+	// The output is drawn into a pooled buffer of 2 MiB, almost twice its size.
+	ops, err := ParseOperations("grayscale")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, opts := range []Options{
+		{Width: 520, Height: 520, Mode: ModeFill},
+		{Width: 520, Height: 520, Mode: ModeFit, Operations: ops},
+	} {
+		img, err := Transform(createTestImage(1040, 1040), opts)
+		if err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+
+		rgba, ok := img.(*image.RGBA)
+		if !ok {
+			t.Fatalf("Expected *image.RGBA, got %T", img)
+		}
+		if cap(rgba.Pix) != len(rgba.Pix) {
+			t.Errorf("Expected an exact buffer of %d bytes, got capacity %d", len(rgba.Pix), cap(rgba.Pix))
+		}
+	}
+}
+
+func TestScaleStripes(t *testing.T) {
+	gopher, _, err := image.Decode(bytes.NewReader(readGopher(t)))
+	if err != nil {
+		t.Fatalf("Failed to decode image: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		src    image.Image
+		sr     image.Rectangle
+		width  int
+		height int
+	}{
+		{"downscale", gopher, gopher.Bounds(), 700, 345},
+		{"crop", gopher, crop(gopher.Bounds(), 300, 300), 300, 300},
+		{"enlarge", gopher, crop(gopher.Bounds(), 4, 3), 1201, 901},
+		{"translucent", goldenSource(), goldenSource().Bounds(), 640, 479},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			serial := image.NewRGBA(image.Rect(0, 0, tt.width, tt.height))
+			scaleTo(serial, tt.src, tt.sr, 1)
+
+			for _, n := range []int{2, 3, 8, 13} {
+				parallel := image.NewRGBA(serial.Rect)
+				scaleTo(parallel, tt.src, tt.sr, n)
+
+				if !bytes.Equal(parallel.Pix, serial.Pix) {
+					t.Errorf("Expected %d stripes to give the serial pixels", n)
+				}
+			}
+		})
+	}
+}
+
+func TestResizeParallel(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+	img := goldenSource()
+
+	resized, err := Resize(img, 1600, 1000)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	serial := image.NewRGBA(image.Rect(0, 0, 1600, 1000))
+	scaleTo(serial, img, crop(img.Bounds(), 1600, 1000), 1)
+
+	if !bytes.Equal(resized.(*image.RGBA).Pix, serial.Pix) {
+		t.Error("Expected the parallel resize to give the serial pixels")
+	}
+}
+
+func TestStripes(t *testing.T) {
+	tests := []struct {
+		width, height int
+		expected      int
+	}{
+		{300, 200, 1},
+		{100000, 10, 1},
+		{8000, 6000, min(runtime.GOMAXPROCS(0), 6000/minStripeHeight)},
+		{1024, 100, 1},
+	}
+
+	for _, tt := range tests {
+		if n := stripes(tt.width, tt.height); n != tt.expected {
+			t.Errorf("stripes(%d, %d) = %d, expected %d", tt.width, tt.height, n, tt.expected)
+		}
+	}
+}
+
+func loadGopher(b *testing.B) image.Image {
+	b.Helper()
+
+	file, err := os.Open("testdata/_gopher_original_1024x504.jpg")
+	if err != nil {
+		b.Fatalf("Failed to open image file: %v", err)
+	}
+	defer file.Close()
+
+	img, _, err := image.Decode(file)
+	if err != nil {
+		b.Fatalf("Failed to decode image: %v", err)
+	}
+
+	return img
+}
+
+// BenchmarkTransform transforms the way the server does: the result is kept and only
+// the intermediate images are reused.
+func BenchmarkTransform(b *testing.B) {
+	img := loadGopher(b)
+
+	for _, opts := range []Options{
+		{Width: 300, Height: 200, Mode: ModeFill},
+		{Width: 300, Height: 200, Mode: ModeFit, Background: color.White},
+	} {
+		b.Run(string(opts.Mode), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := Transform(img, opts); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkResizeLarge scales a large output serially and in stripes on every core.
+func BenchmarkResizeLarge(b *testing.B) {
+	img := loadGopher(b)
+	dst := image.NewRGBA(image.Rect(0, 0, 4000, 1968))
+
+	for _, parallel := range []bool{false, true} {
+		n := 1
+		if parallel {
+			n = stripes(dst.Rect.Dx(), dst.Rect.Dy())
+		}
+
+		b.Run("parallel="+strconv.FormatBool(parallel), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				scaleTo(dst, img, img.Bounds(), n)
+			}
+		})
+	}
+}
+
+// BenchmarkTransformPipeline resizes with orientation and filters, whose intermediate
+// images come from and return to the pool, against plain allocations. The result is
+// kept as by the server.
+func BenchmarkTransformPipeline(b *testing.B) {
+	img := loadGopher(b)
+	ops, err := ParseOperations("rotate:90,flip:h,grayscale,contrast:20,sharpen:1")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	opts := Options{Width: 300, Height: 200, Mode: ModeFill, Enlarge: true, Operations: ops, Background: color.White}
+
+	for _, pooled := range []bool{true, false} {
+		b.Run("pooled="+strconv.FormatBool(pooled), func(b *testing.B) {
+			poolBuffers = pooled
+			defer func() { poolBuffers = true }()
+
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := Transform(img, opts); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
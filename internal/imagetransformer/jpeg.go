@@ -0,0 +1,119 @@
+package imagetransformer
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+
+	"github.com/heltirj/image_previewer/internal/imagetransformer/jpegscale"
+)
+
+// jpegScales are the reduced sizes a JPEG can be decoded at, largest reduction first.
+var jpegScales = []int{8, 4, 2}
+
+// decodeScaled decodes a JPEG at a reduced size. The forked decoder only handles the
+// reductions; sources decoded whole go through image/jpeg, which gets upstream fixes.
+var decodeScaled = jpegscale.DecodeScaled
+
+// DecodeJPEG decodes a JPEG source for Transform with opts. When the output is much
+// smaller than the source, the image is decoded at 1/2, 1/4 or 1/8 of its size, which
+// is several times faster than decoding it whole and averages the pixels instead of
+// skipping them. The decoded image is never smaller than the output needs, and the
+// returned options give the same output size for it as opts give for the source.
+func DecodeJPEG(data []byte, opts Options) (image.Image, Options, error) {
+	config, err := jpeg.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, opts, err
+	}
+
+	denom := 1
+	scaled, ok := resolveSizes(config.Width, config.Height, opts)
+	if ok {
+		denom = jpegScale(config.Width, config.Height, scaled)
+		opts = scaled
+	}
+
+	var img image.Image
+	if denom == 1 {
+		img, err = jpeg.Decode(bytes.NewReader(data))
+	} else {
+		img, err = decodeScaled(bytes.NewReader(data), denom)
+	}
+	if err != nil {
+		return nil, opts, err
+	}
+
+	return img, opts, nil
+}
+
+// resolveSizes computes the exact output size of opts for a srcWidth x srcHeight source
+// and returns options requesting it in a way that does not depend on the source size.
+func resolveSizes(srcWidth, srcHeight int, opts Options) (Options, bool) {
+	if swapsAxes(opts.Operations) {
+		srcWidth, srcHeight = srcHeight, srcWidth
+	}
+
+	width, height, err := getAutoSizes(srcWidth, srcHeight, opts.Width, opts.Height)
+	if err != nil {
+		return opts, false
+	}
+	width, height = getLimitedSizes(width, height, opts.MaxWidth, opts.MaxHeight)
+
+	switch opts.Mode {
+	case ModeFit:
+		width, height = getFitSizes(srcWidth, srcHeight, width, height)
+		if !opts.Enlarge && (width > srcWidth || height > srcHeight) {
+			width, height = srcWidth, srcHeight
+		}
+		// The fitted size keeps the aspect ratio of the source, so stretching to it is
+		// the same as fitting.
+		opts.Mode = ModeStretch
+	case ModeStretch:
+		if !opts.Enlarge {
+			width, height = min(width, srcWidth), min(height, srcHeight)
+		}
+	default:
+		if !opts.Enlarge {
+			width, height = getCappedSizes(srcWidth, srcHeight, width, height)
+		}
+	}
+
+	opts.Width, opts.Height = width, height
+
+	return opts, true
+}
+
+// jpegScale returns the largest denominator the source can be decoded at so that it
+// still has at least as many pixels as the output uses in each direction.
+func jpegScale(srcWidth, srcHeight int, opts Options) int {
+	width, height := opts.Width, opts.Height
+	if swapsAxes(opts.Operations) {
+		width, height = height, width
+	}
+
+	// Filling uses only the centered part of the source with the output aspect ratio.
+	usedWidth, usedHeight := srcWidth, srcHeight
+	if opts.Mode != ModeStretch {
+		usedWidth, usedHeight = getCroppedSizes(srcWidth, srcHeight, width, height)
+	}
+
+	for _, denom := range jpegScales {
+		if usedWidth/denom >= width && usedHeight/denom >= height {
+			return denom
+		}
+	}
+
+	return 1
+}
+
+// swapsAxes reports whether ops turn the image by 90 or 270 degrees in total.
+func swapsAxes(ops Operations) bool {
+	swapped := false
+	for _, op := range ops {
+		if r, ok := op.(Rotate); ok && r%180 != 0 {
+			swapped = !swapped
+		}
+	}
+
+	return swapped
+}
@@ -0,0 +1,184 @@
+package imagetransformer
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"io"
+	"math"
+	"os"
+	"testing"
+
+	"github.com/heltirj/image_previewer/internal/imagetransformer/jpegscale"
+	"golang.org/x/image/draw"
+)
+
+func readGopher(tb testing.TB) []byte {
+	tb.Helper()
+
+	data, err := os.ReadFile("testdata/_gopher_original_1024x504.jpg")
+	if err != nil {
+		tb.Fatalf("Failed to read image file: %v", err)
+	}
+
+	return data
+}
+
+func TestDecodeJPEG(t *testing.T) {
+	data := readGopher(t)
+	full, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Failed to decode image: %v", err)
+	}
+
+	rotate, err := ParseOperations("rotate:90")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		opts  Options
+		denom int
+	}{
+		{"fill", Options{Width: 100, Height: 50, Mode: ModeFill}, 8},
+		{"fill tall", Options{Width: 50, Height: 100, Mode: ModeFill}, 4},
+		{"fit", Options{Width: 200, Height: 200, Mode: ModeFit}, 4},
+		{"stretch", Options{Width: 300, Height: 100, Mode: ModeStretch}, 2},
+		{"auto height", Options{Width: 128, Mode: ModeFill}, 8},
+		{"rotated", Options{Width: 63, Height: 128, Mode: ModeFill, Operations: rotate}, 8},
+		{"large", Options{Width: 800, Height: 400, Mode: ModeFill}, 1},
+		{"enlarged", Options{Width: 2000, Height: 1000, Mode: ModeFit, Enlarge: true}, 1},
+		{"capped", Options{Width: 2000, Height: 1000, Mode: ModeFill}, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want, err := Transform(full, tt.opts)
+			if err != nil {
+				t.Fatalf("Expected no error, got: %v", err)
+			}
+
+			decoded, opts, err := DecodeJPEG(data, tt.opts)
+			if err != nil {
+				t.Fatalf("Expected no error, got: %v", err)
+			}
+			if denom := 1024 / decoded.Bounds().Dx(); denom != tt.denom {
+				t.Errorf("Expected the source decoded at 1/%d, got 1/%d", tt.denom, denom)
+			}
+
+			got, err := Transform(decoded, opts)
+			if err != nil {
+				t.Fatalf("Expected no error, got: %v", err)
+			}
+			if got.Bounds() != want.Bounds() {
+				t.Fatalf("Expected %v, got %v", want.Bounds(), got.Bounds())
+			}
+			if p := psnr(got, want); p < 25 {
+				t.Errorf("Expected the same picture, PSNR is %.1f dB", p)
+			}
+		})
+	}
+}
+
+func TestDecodeJPEGFullScale(t *testing.T) {
+	data := readGopher(t)
+
+	var denoms []int
+	decodeScaled = func(r io.Reader, denom int) (image.Image, error) {
+		denoms = append(denoms, denom)
+		return jpegscale.DecodeScaled(r, denom)
+	}
+	defer func() { decodeScaled = jpegscale.DecodeScaled }()
+
+	for _, opts := range []Options{
+		{Width: 800, Height: 400, Mode: ModeFill},
+		{Width: 2000, Height: 1000, Mode: ModeFit, Enlarge: true},
+		{Width: 100, Height: 50, Mode: ModeFill},
+	} {
+		if _, _, err := DecodeJPEG(data, opts); err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+	}
+
+	// Only the reduced decode goes through the forked decoder.
+	if len(denoms) != 1 || denoms[0] != 8 {
+		t.Errorf("Expected the forked decoder to be used once at 1/8, got %v", denoms)
+	}
+}
+
+func TestDecodeJPEGInvalid(t *testing.T) {
+	if _, _, err := DecodeJPEG([]byte("not a jpeg"), Options{Width: 10, Height: 10}); err == nil {
+		t.Error("Expected an error")
+	}
+}
+
+// BenchmarkDecodeJPEG compares decoding the whole source and resizing it with
+// ApproxBiLinear to decoding it at a reduced scale first. The dB metric is the PSNR of
+// the result against a CatmullRom downscale of the whole source, higher is better.
+func BenchmarkDecodeJPEG(b *testing.B) {
+	data := readGopher(b)
+	full, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		b.Fatalf("Failed to decode image: %v", err)
+	}
+
+	for _, size := range []image.Point{{100, 50}, {300, 150}} {
+		opts := Options{Width: size.X, Height: size.Y, Mode: ModeFill}
+
+		reference := newRGBA(image.Rect(0, 0, size.X, size.Y))
+		draw.CatmullRom.Scale(reference, reference.Rect, full, crop(full.Bounds(), size.X, size.Y), draw.Src, nil)
+
+		decoders := map[string]func() (image.Image, Options, error){
+			"full": func() (image.Image, Options, error) {
+				img, _, err := image.Decode(bytes.NewReader(data))
+				return img, opts, err
+			},
+			"scaled": func() (image.Image, Options, error) {
+				return DecodeJPEG(data, opts)
+			},
+		}
+
+		for name, decode := range decoders {
+			b.Run(name+"/"+size.String(), func(b *testing.B) {
+				var result image.Image
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					img, opts, err := decode()
+					if err != nil {
+						b.Fatal(err)
+					}
+					if result, err = Transform(img, opts); err != nil {
+						b.Fatal(err)
+					}
+				}
+				b.ReportMetric(psnr(result, reference), "dB")
+			})
+		}
+	}
+}
+
+// psnr returns the peak signal-to-noise ratio of the RGB channels of img against ref.
+func psnr(img, ref image.Image) float64 {
+	b := img.Bounds()
+
+	var sum float64
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			c := color.RGBAModel.Convert(img.At(b.Min.X+x, b.Min.Y+y)).(color.RGBA)
+			r := color.RGBAModel.Convert(ref.At(ref.Bounds().Min.X+x, ref.Bounds().Min.Y+y)).(color.RGBA)
+			for _, d := range []float64{
+				float64(c.R) - float64(r.R), float64(c.G) - float64(r.G), float64(c.B) - float64(r.B),
+			} {
+				sum += d * d
+			}
+		}
+	}
+
+	mse := sum / float64(3*b.Dx()*b.Dy())
+	if mse == 0 {
+		return math.Inf(1)
+	}
+
+	return 10 * math.Log10(255*255/mse)
+}
@@ -0,0 +1,120 @@
+package jpegscale
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testJPEGs(t *testing.T) map[string][]byte {
+	t.Helper()
+
+	gopher, err := os.ReadFile("../testdata/_gopher_original_1024x504.jpg")
+	if err != nil {
+		t.Fatalf("Failed to read the test image: %v", err)
+	}
+
+	// An odd size checks the rounding of partial blocks.
+	gray := image.NewGray(image.Rect(0, 0, 203, 117))
+	for y := 0; y < 117; y++ {
+		for x := 0; x < 203; x++ {
+			gray.Pix[y*gray.Stride+x] = uint8(x + y)
+		}
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, gray, &jpeg.Options{Quality: 95}); err != nil {
+		t.Fatalf("Failed to encode the test image: %v", err)
+	}
+
+	jpegs := map[string][]byte{"gopher": gopher, "gray": buf.Bytes()}
+
+	// Samples of the standard library cover progressive, CMYK and unusual subsampling
+	// ratios.
+	names, err := filepath.Glob("testdata/*.jpeg")
+	if err != nil {
+		t.Fatalf("Failed to list the test images: %v", err)
+	}
+	for _, name := range names {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatalf("Failed to read the test image: %v", err)
+		}
+		jpegs[filepath.Base(name)] = data
+	}
+
+	return jpegs
+}
+
+func TestDecodeScaled(t *testing.T) {
+	for name, data := range testJPEGs(t) {
+		full, err := jpeg.Decode(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("%s: failed to decode: %v", name, err)
+		}
+		width, height := full.Bounds().Dx(), full.Bounds().Dy()
+
+		for _, denom := range []int{1, 2, 4, 8} {
+			img, err := DecodeScaled(bytes.NewReader(data), denom)
+			if err != nil {
+				t.Fatalf("%s 1/%d: expected no error, got: %v", name, denom, err)
+			}
+
+			wantWidth, wantHeight := (width+denom-1)/denom, (height+denom-1)/denom
+			if img.Bounds() != image.Rect(0, 0, wantWidth, wantHeight) {
+				t.Fatalf("%s 1/%d: expected %dx%d, got %v", name, denom, wantWidth, wantHeight, img.Bounds())
+			}
+
+			// The reduced IDCT approximates the average of each denom x denom square. The
+			// samples are small and detailed, so subsampled chroma still differs a bit.
+			if diff := meanDiff(img, full, denom); diff > 8 {
+				t.Errorf("%s 1/%d: mean difference from the full decode is %.2f", name, denom, diff)
+			}
+		}
+	}
+}
+
+func TestDecodeScaledInvalid(t *testing.T) {
+	data := testJPEGs(t)["gray"]
+	if _, err := DecodeScaled(bytes.NewReader(data), 3); err == nil {
+		t.Error("Expected an error for denominator 3")
+	}
+}
+
+// meanDiff returns the mean absolute difference per channel between img and full
+// averaged over denom x denom squares.
+func meanDiff(img, full image.Image, denom int) float64 {
+	b := img.Bounds()
+	fb := full.Bounds()
+
+	var total float64
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			var sum [3]float64
+			var n float64
+			for sy := y * denom; sy < min((y+1)*denom, fb.Max.Y); sy++ {
+				for sx := x * denom; sx < min((x+1)*denom, fb.Max.X); sx++ {
+					c := color.RGBAModel.Convert(full.At(sx, sy)).(color.RGBA)
+					sum[0] += float64(c.R)
+					sum[1] += float64(c.G)
+					sum[2] += float64(c.B)
+					n++
+				}
+			}
+
+			c := color.RGBAModel.Convert(img.At(x, y)).(color.RGBA)
+			for i, v := range []uint8{c.R, c.G, c.B} {
+				d := float64(v) - sum[i]/n
+				if d < 0 {
+					d = -d
+				}
+				total += d
+			}
+		}
+	}
+
+	return total / float64(3*b.Dx()*b.Dy())
+}
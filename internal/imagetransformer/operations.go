@@ -0,0 +1,380 @@
+package imagetransformer
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"math"
+	"strconv"
+	"strings"
+
+	"golang.org/x/image/draw"
+)
+
+const (
+	maxOperations = 10
+	maxBlurSigma  = 20
+)
+
+var ErrInvalidOperation = errors.New("invalid operation")
+
+// Operation is a single step of the pipeline applied to the image besides resizing.
+// String returns its canonical form, e.g. "rotate:90".
+type Operation interface {
+	String() string
+	apply(img *image.RGBA) *image.RGBA
+}
+
+// Operations is an ordered pipeline; its String is deterministic and is used as part
+// of cache keys.
+type Operations []Operation
+
+func (ops Operations) String() string {
+	names := make([]string, 0, len(ops))
+	for _, op := range ops {
+		names = append(names, op.String())
+	}
+
+	return strings.Join(names, ",")
+}
+
+// ParseOperations parses a comma separated list like "rotate:90,flip:h,blur:1.5,grayscale".
+func ParseOperations(s string) (Operations, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	parts := strings.Split(s, ",")
+	if len(parts) > maxOperations {
+		return nil, fmt.Errorf("%w: at most %d operations are allowed", ErrInvalidOperation, maxOperations)
+	}
+
+	ops := make(Operations, 0, len(parts))
+	for _, part := range parts {
+		op, err := parseOperation(strings.TrimSpace(part))
+		if err != nil {
+			return nil, err
+		}
+		ops = append(ops, op)
+	}
+
+	return ops, nil
+}
+
+func parseOperation(s string) (Operation, error) {
+	name, arg, _ := strings.Cut(s, ":")
+
+	switch name {
+	case "rotate":
+		switch arg {
+		case "90", "180", "270":
+			angle, _ := strconv.Atoi(arg)
+			return Rotate(angle), nil
+		}
+	case "flip":
+		switch arg {
+		case "h", "v":
+			return Flip(arg), nil
+		}
+	case "blur":
+		if sigma, err := strconv.ParseFloat(arg, 64); err == nil && sigma > 0 && sigma <= maxBlurSigma {
+			return Blur(sigma), nil
+		}
+	case "sharpen":
+		if sigma, err := strconv.ParseFloat(arg, 64); err == nil && sigma > 0 && sigma <= maxBlurSigma {
+			return Sharpen(sigma), nil
+		}
+	case "grayscale":
+		if arg == "" {
+			return Grayscale{}, nil
+		}
+	case "brightness":
+		if value, err := strconv.Atoi(arg); err == nil && value >= -100 && value <= 100 {
+			return Brightness(value), nil
+		}
+	case "contrast":
+		if value, err := strconv.Atoi(arg); err == nil && value >= -100 && value <= 100 {
+			return Contrast(value), nil
+		}
+	}
+
+	return nil, fmt.Errorf("%w: %q", ErrInvalidOperation, s)
+}
+
+// Rotate turns the image clockwise by 90, 180 or 270 degrees.
+type Rotate int
+
+func (r Rotate) String() string {
+	return "rotate:" + strconv.Itoa(int(r))
+}
+
+func (r Rotate) apply(src *image.RGBA) *image.RGBA {
+	w, h := src.Rect.Dx(), src.Rect.Dy()
+
+	var dst *image.RGBA
+	var at func(x, y int) (int, int)
+	switch r {
+	case 90:
+		dst = newRGBA(image.Rect(0, 0, h, w))
+		at = func(x, y int) (int, int) { return y, h - 1 - x }
+	case 270:
+		dst = newRGBA(image.Rect(0, 0, h, w))
+		at = func(x, y int) (int, int) { return w - 1 - y, x }
+	default:
+		dst = newRGBA(image.Rect(0, 0, w, h))
+		at = func(x, y int) (int, int) { return w - 1 - x, h - 1 - y }
+	}
+
+	remap(dst, src, at)
+	return dst
+}
+
+// Flip mirrors the image horizontally ("h") or vertically ("v").
+type Flip string
+
+func (f Flip) String() string {
+	return "flip:" + string(f)
+}
+
+func (f Flip) apply(src *image.RGBA) *image.RGBA {
+	w, h := src.Rect.Dx(), src.Rect.Dy()
+	dst := newRGBA(image.Rect(0, 0, w, h))
+
+	if f == "v" {
+		remap(dst, src, func(x, y int) (int, int) { return x, h - 1 - y })
+	} else {
+		remap(dst, src, func(x, y int) (int, int) { return w - 1 - x, y })
+	}
+
+	return dst
+}
+
+// Blur is a gaussian blur with the given sigma in pixels.
+type Blur float64
+
+func (b Blur) String() string {
+	return "blur:" + strconv.FormatFloat(float64(b), 'f', -1, 64)
+}
+
+func (b Blur) apply(src *image.RGBA) *image.RGBA {
+	return gaussianBlur(src, float64(b))
+}
+
+// Sharpen is an unsharp mask: the difference between the image and its gaussian blur
+// with the given sigma is added back to the image.
+type Sharpen float64
+
+func (s Sharpen) String() string {
+	return "sharpen:" + strconv.FormatFloat(float64(s), 'f', -1, 64)
+}
+
+func (s Sharpen) apply(src *image.RGBA) *image.RGBA {
+	blurred := gaussianBlur(src, float64(s))
+	defer putRGBA(blurred)
+
+	dst := newRGBA(src.Rect)
+	for i := 0; i < len(src.Pix); i += 4 {
+		a := src.Pix[i+3]
+		for c := 0; c < 3; c++ {
+			v := 2*int(src.Pix[i+c]) - int(blurred.Pix[i+c])
+			dst.Pix[i+c] = clampTo(v, a)
+		}
+		dst.Pix[i+3] = a
+	}
+
+	return dst
+}
+
+// Grayscale replaces colors by their luma.
+type Grayscale struct{}
+
+func (Grayscale) String() string {
+	return "grayscale"
+}
+
+func (Grayscale) apply(src *image.RGBA) *image.RGBA {
+	dst := newRGBA(src.Rect)
+	for i := 0; i < len(src.Pix); i += 4 {
+		y := uint8((299*int(src.Pix[i]) + 587*int(src.Pix[i+1]) + 114*int(src.Pix[i+2]) + 500) / 1000)
+		dst.Pix[i], dst.Pix[i+1], dst.Pix[i+2], dst.Pix[i+3] = y, y, y, src.Pix[i+3]
+	}
+
+	return dst
+}
+
+// Brightness shifts colors by the given percentage of the full range, -100..100.
+type Brightness int
+
+func (b Brightness) String() string {
+	return "brightness:" + strconv.Itoa(int(b))
+}
+
+func (b Brightness) apply(src *image.RGBA) *image.RGBA {
+	return mapColors(src, func(v, a int) int {
+		return v + int(b)*a/100
+	})
+}
+
+// Contrast scales colors away from (positive) or towards (negative) the middle gray by
+// the given percentage, -100..100.
+type Contrast int
+
+func (c Contrast) String() string {
+	return "contrast:" + strconv.Itoa(int(c))
+}
+
+func (c Contrast) apply(src *image.RGBA) *image.RGBA {
+	factor := float64(100+int(c)) / 100
+
+	return mapColors(src, func(v, a int) int {
+		mid := float64(a) / 2
+		return int(math.Round((float64(v)-mid)*factor + mid))
+	})
+}
+
+// applyOperations runs ops in order; a nil or empty pipeline returns img unchanged.
+// The images between the steps are released, img itself is left alone.
+func applyOperations(img image.Image, ops Operations) image.Image {
+	if len(ops) == 0 {
+		return img
+	}
+
+	rgba := toRGBA(img)
+	for _, op := range ops {
+		next := op.apply(rgba)
+		if next != rgba && image.Image(rgba) != img {
+			putRGBA(rgba)
+		}
+		rgba = next
+	}
+
+	return rgba
+}
+
+// splitOperations separates the operations changing orientation from the filters. Both
+// groups commute with each other, so running orientation before resizing and filters
+// after it gives the same image as running them in order, while the requested size
+// applies to the final orientation and the filters process fewer pixels. Overlays do
+// not commute with orientation and are expected at the end of the pipeline.
+func splitOperations(ops Operations) (orientation, filters Operations) {
+	for _, op := range ops {
+		switch op.(type) {
+		case Rotate, Flip:
+			orientation = append(orientation, op)
+		default:
+			filters = append(filters, op)
+		}
+	}
+
+	return orientation, filters
+}
+
+func toRGBA(img image.Image) *image.RGBA {
+	if rgba, ok := img.(*image.RGBA); ok && rgba.Rect.Min == (image.Point{}) {
+		return rgba
+	}
+
+	b := img.Bounds()
+	rgba := newRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(rgba, rgba.Rect, img, b.Min, draw.Src)
+
+	return rgba
+}
+
+// remap fills dst with the pixels of src at the coordinates returned by at.
+func remap(dst, src *image.RGBA, at func(x, y int) (int, int)) {
+	b := dst.Rect
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			i, j := dst.PixOffset(x, y), src.PixOffset(at(x, y))
+			copy(dst.Pix[i:i+4], src.Pix[j:j+4])
+		}
+	}
+}
+
+// mapColors applies f to every premultiplied color channel, passing the alpha so that
+// f can scale its adjustment, and clamps the result to the valid range.
+func mapColors(src *image.RGBA, f func(v, a int) int) *image.RGBA {
+	dst := newRGBA(src.Rect)
+	for i := 0; i < len(src.Pix); i += 4 {
+		a := src.Pix[i+3]
+		for c := 0; c < 3; c++ {
+			dst.Pix[i+c] = clampTo(f(int(src.Pix[i+c]), int(a)), a)
+		}
+		dst.Pix[i+3] = a
+	}
+
+	return dst
+}
+
+// clampTo keeps a premultiplied channel value within [0, alpha].
+func clampTo(v int, alpha uint8) uint8 {
+	return uint8(max(0, min(v, int(alpha))))
+}
+
+// gaussianBlur convolves all channels with a separable gaussian kernel, clamping
+// coordinates at the edges.
+func gaussianBlur(src *image.RGBA, sigma float64) *image.RGBA {
+	kernel := gaussianKernel(sigma)
+	radius := len(kernel) / 2
+	w, h := src.Rect.Dx(), src.Rect.Dy()
+
+	tmp := newRGBA(src.Rect)
+	defer putRGBA(tmp)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var sum [4]float64
+			for k, weight := range kernel {
+				sx := max(0, min(x+k-radius, w-1))
+				i := src.PixOffset(sx, y)
+				for c := 0; c < 4; c++ {
+					sum[c] += weight * float64(src.Pix[i+c])
+				}
+			}
+			storePixel(tmp, tmp.PixOffset(x, y), sum)
+		}
+	}
+
+	dst := newRGBA(src.Rect)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var sum [4]float64
+			for k, weight := range kernel {
+				sy := max(0, min(y+k-radius, h-1))
+				i := tmp.PixOffset(x, sy)
+				for c := 0; c < 4; c++ {
+					sum[c] += weight * float64(tmp.Pix[i+c])
+				}
+			}
+			storePixel(dst, dst.PixOffset(x, y), sum)
+		}
+	}
+
+	return dst
+}
+
+func storePixel(img *image.RGBA, i int, values [4]float64) {
+	a := uint8(math.Round(min(values[3], 255)))
+	img.Pix[i+3] = a
+	for c := 0; c < 3; c++ {
+		img.Pix[i+c] = clampTo(int(math.Round(values[c])), a)
+	}
+}
+
+func gaussianKernel(sigma float64) []float64 {
+	radius := int(math.Ceil(sigma * 3))
+	kernel := make([]float64, 2*radius+1)
+
+	var sum float64
+	for i := range kernel {
+		d := float64(i - radius)
+		kernel[i] = math.Exp(-d * d / (2 * sigma * sigma))
+		sum += kernel[i]
+	}
+
+	for i := range kernel {
+		kernel[i] /= sum
+	}
+
+	return kernel
+}
@@ -0,0 +1,182 @@
+package imagetransformer
+
+import (
+	"errors"
+	"flag"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite golden images in testdata/operations")
+
+// goldenSource is a small image with gradients, a sharp edge and a semi-transparent row,
+// so that every operation changes it in a visible way.
+func goldenSource() *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, 8, 6))
+	for y := 0; y < 6; y++ {
+		for x := 0; x < 8; x++ {
+			c := color.NRGBA{R: uint8(x * 32), G: uint8(y * 48), B: 200, A: 255}
+			if x >= 4 {
+				c.B = 20
+			}
+			if y == 5 {
+				c.A = 128
+			}
+			img.Set(x, y, c)
+		}
+	}
+
+	return img
+}
+
+func TestOperationsGolden(t *testing.T) {
+	for _, spec := range []string{
+		"rotate:90", "rotate:180", "rotate:270", "flip:h", "flip:v", "blur:1", "sharpen:1",
+		"grayscale", "brightness:30", "brightness:-30", "contrast:50", "contrast:-50",
+	} {
+		t.Run(spec, func(t *testing.T) {
+			ops, err := ParseOperations(spec)
+			if err != nil {
+				t.Fatalf("Expected no error, got: %v", err)
+			}
+
+			got := toRGBA(applyOperations(goldenSource(), ops))
+			golden := filepath.Join("testdata", "operations", strings.ReplaceAll(spec, ":", "_")+".png")
+
+			if *update {
+				writeGolden(t, golden, got)
+			}
+
+			want := readGolden(t, golden)
+			if got.Rect != want.Rect {
+				t.Fatalf("Expected bounds %v, got %v", want.Rect, got.Rect)
+			}
+
+			// Allow rounding differences of floating point math between platforms.
+			for i := range got.Pix {
+				if d := int(got.Pix[i]) - int(want.Pix[i]); d < -1 || d > 1 {
+					t.Fatalf("Pixel %v differs from golden: got %v, want %v", i/4,
+						got.Pix[i-i%4:i-i%4+4], want.Pix[i-i%4:i-i%4+4])
+				}
+			}
+		})
+	}
+}
+
+func writeGolden(t *testing.T, path string, img image.Image) {
+	t.Helper()
+
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		t.Fatalf("Failed to create golden dir: %v", err)
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("Failed to create golden image: %v", err)
+	}
+	defer file.Close()
+
+	if err := png.Encode(file, img); err != nil {
+		t.Fatalf("Failed to encode golden image: %v", err)
+	}
+}
+
+func readGolden(t *testing.T, path string) *image.RGBA {
+	t.Helper()
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Failed to open golden image, run with -update to create it: %v", err)
+	}
+	defer file.Close()
+
+	img, err := png.Decode(file)
+	if err != nil {
+		t.Fatalf("Failed to decode golden image: %v", err)
+	}
+
+	return toRGBA(img)
+}
+
+func TestRotateFlipPixels(t *testing.T) {
+	// 1 2 3
+	// 4 5 6
+	src := image.NewRGBA(image.Rect(0, 0, 3, 2))
+	for i := 0; i < 6; i++ {
+		src.Pix[i*4] = uint8(i + 1)
+		src.Pix[i*4+3] = 255
+	}
+
+	tests := []struct {
+		op       Operation
+		width    int
+		expected []uint8
+	}{
+		{Rotate(90), 2, []uint8{4, 1, 5, 2, 6, 3}},
+		{Rotate(180), 3, []uint8{6, 5, 4, 3, 2, 1}},
+		{Rotate(270), 2, []uint8{3, 6, 2, 5, 1, 4}},
+		{Flip("h"), 3, []uint8{3, 2, 1, 6, 5, 4}},
+		{Flip("v"), 3, []uint8{4, 5, 6, 1, 2, 3}},
+	}
+
+	for _, tt := range tests {
+		dst := tt.op.apply(src)
+		if dst.Rect.Dx() != tt.width {
+			t.Errorf("For %v expected width %d, got %d", tt.op, tt.width, dst.Rect.Dx())
+		}
+
+		for i, expected := range tt.expected {
+			if dst.Pix[i*4] != expected {
+				t.Errorf("For %v expected %v, got pixel %d = %d", tt.op, tt.expected, i, dst.Pix[i*4])
+				break
+			}
+		}
+	}
+}
+
+func TestParseOperations(t *testing.T) {
+	ops, err := ParseOperations("rotate:90, flip:h,blur:1.50,sharpen:1,grayscale,brightness:10,contrast:-20")
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	expected := "rotate:90,flip:h,blur:1.5,sharpen:1,grayscale,brightness:10,contrast:-20"
+	if ops.String() != expected {
+		t.Errorf("Expected canonical form %q, got %q", expected, ops.String())
+	}
+
+	for _, spec := range []string{
+		"rotate:45", "flip:x", "blur:0", "blur:100", "sharpen:abc", "grayscale:1", "brightness:101",
+		"contrast:abc", "sepia", "rotate:90,,flip:h", strings.Repeat("grayscale,", maxOperations) + "grayscale",
+	} {
+		if _, err := ParseOperations(spec); !errors.Is(err, ErrInvalidOperation) {
+			t.Errorf("Expected ErrInvalidOperation for %q, got: %v", spec, err)
+		}
+	}
+}
+
+func TestTransformOperations(t *testing.T) {
+	ops, err := ParseOperations("rotate:90,grayscale")
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	img, err := Transform(createTestImage(400, 200), Options{Width: 100, Height: 100, Mode: ModeFit, Operations: ops})
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	if img.Bounds().Dx() != 50 || img.Bounds().Dy() != 100 {
+		t.Errorf("Expected rotated image to fit into 50x100, got %dx%d", img.Bounds().Dx(), img.Bounds().Dy())
+	}
+
+	r, g, b, _ := img.At(10, 10).RGBA()
+	if r != g || g != b {
+		t.Errorf("Expected gray pixel, got %d %d %d", r, g, b)
+	}
+}
@@ -0,0 +1,138 @@
+package imagetransformer
+
+import (
+	"image"
+	"image/color"
+
+	"golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+// Position is the place of an overlay on the image.
+type Position string
+
+const (
+	PositionTopLeft     Position = "top-left"
+	PositionTop         Position = "top"
+	PositionTopRight    Position = "top-right"
+	PositionLeft        Position = "left"
+	PositionCenter      Position = "center"
+	PositionRight       Position = "right"
+	PositionBottomLeft  Position = "bottom-left"
+	PositionBottom      Position = "bottom"
+	PositionBottomRight Position = "bottom-right"
+)
+
+// Overlay is an operation compositing a watermark image, or a text when Image is nil,
+// onto the image. Name identifies the watermark in the canonical form of the pipeline,
+// so different watermarks must have different names.
+type Overlay struct {
+	Name  string
+	Image image.Image
+	Text  string
+	Color color.Color
+	// Position defaults to the bottom right corner.
+	Position Position
+	// Scale is the width of the watermark relative to the image width; zero keeps the
+	// original size.
+	Scale float64
+	// Opacity of the watermark from 0 to 1.
+	Opacity float64
+	// Margin from the image edges in pixels.
+	Margin int
+}
+
+func (o *Overlay) String() string {
+	return "overlay:" + o.Name
+}
+
+func (o *Overlay) apply(src *image.RGBA) *image.RGBA {
+	mark := o.Image
+	if mark == nil {
+		mark = renderText(o.Text, o.Color)
+	}
+
+	bounds := src.Rect
+	width, height := mark.Bounds().Dx(), mark.Bounds().Dy()
+	if o.Scale > 0 {
+		width = int(float64(bounds.Dx()) * o.Scale)
+		height = height * width / max(1, mark.Bounds().Dx())
+	}
+
+	// The watermark never covers more than the image without the margins.
+	if maxWidth := bounds.Dx() - 2*o.Margin; width > maxWidth {
+		height, width = height*maxWidth/max(1, width), maxWidth
+	}
+	if maxHeight := bounds.Dy() - 2*o.Margin; height > maxHeight {
+		width, height = width*maxHeight/max(1, height), maxHeight
+	}
+	if width <= 0 || height <= 0 {
+		return src
+	}
+
+	scaled := newRGBA(image.Rect(0, 0, width, height))
+	defer putRGBA(scaled)
+	draw.ApproxBiLinear.Scale(scaled, scaled.Rect, mark, mark.Bounds(), draw.Src, nil)
+
+	dst := newRGBA(bounds)
+	copy(dst.Pix, src.Pix)
+
+	at := o.origin(bounds, width, height)
+	mask := image.NewUniform(color.Alpha{A: uint8(min(1, max(0, o.Opacity)) * 255)})
+	draw.DrawMask(dst, image.Rect(at.X, at.Y, at.X+width, at.Y+height), scaled, image.Point{}, mask,
+		image.Point{}, draw.Over)
+
+	return dst
+}
+
+// origin returns the top left corner of a width x height watermark in bounds.
+func (o *Overlay) origin(bounds image.Rectangle, width, height int) image.Point {
+	left := bounds.Min.X + o.Margin
+	centerX := bounds.Min.X + (bounds.Dx()-width)/2
+	right := bounds.Max.X - o.Margin - width
+	top := bounds.Min.Y + o.Margin
+	centerY := bounds.Min.Y + (bounds.Dy()-height)/2
+	bottom := bounds.Max.Y - o.Margin - height
+
+	switch o.Position {
+	case PositionTopLeft:
+		return image.Pt(left, top)
+	case PositionTop:
+		return image.Pt(centerX, top)
+	case PositionTopRight:
+		return image.Pt(right, top)
+	case PositionLeft:
+		return image.Pt(left, centerY)
+	case PositionCenter:
+		return image.Pt(centerX, centerY)
+	case PositionRight:
+		return image.Pt(right, centerY)
+	case PositionBottomLeft:
+		return image.Pt(left, bottom)
+	case PositionBottom:
+		return image.Pt(centerX, bottom)
+	case PositionBottomRight:
+		return image.Pt(right, bottom)
+	default:
+		return image.Pt(right, bottom)
+	}
+}
+
+// renderText draws text with the basic font on a transparent image that fits it exactly.
+func renderText(text string, c color.Color) image.Image {
+	if c == nil {
+		c = color.White
+	}
+
+	face := basicfont.Face7x13
+	drawer := &font.Drawer{Src: image.NewUniform(c), Face: face}
+
+	img := image.NewRGBA(image.Rect(0, 0, drawer.MeasureString(text).Ceil(), face.Height))
+	drawer.Dst = img
+	drawer.Dot = fixed.P(0, face.Ascent)
+	drawer.DrawString(text)
+
+	return img
+}
@@ -0,0 +1,96 @@
+package imagetransformer
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+)
+
+func solidImage(width, height int, c color.Color) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(img, img.Rect, image.NewUniform(c), image.Point{}, draw.Src)
+
+	return img
+}
+
+func TestOverlayPosition(t *testing.T) {
+	red := color.RGBA{R: 255, A: 255}
+	black := color.RGBA{A: 255}
+	mark := solidImage(10, 10, red)
+
+	tests := []struct {
+		position Position
+		inside   image.Point
+		outside  image.Point
+	}{
+		{PositionBottomRight, image.Pt(80, 30), image.Pt(70, 30)},
+		{PositionTopLeft, image.Pt(10, 10), image.Pt(30, 10)},
+		{PositionCenter, image.Pt(50, 25), image.Pt(30, 25)},
+		{"", image.Pt(94, 44), image.Pt(97, 47)},
+	}
+
+	for _, tt := range tests {
+		overlay := &Overlay{Name: "logo", Image: mark, Position: tt.position, Scale: 0.2, Opacity: 1, Margin: 5}
+		dst := overlay.apply(solidImage(100, 50, black))
+
+		if got := dst.RGBAAt(tt.inside.X, tt.inside.Y); got != red {
+			t.Errorf("For %q expected watermark at %v, got %v", tt.position, tt.inside, got)
+		}
+		if got := dst.RGBAAt(tt.outside.X, tt.outside.Y); got != black {
+			t.Errorf("For %q expected no watermark at %v, got %v", tt.position, tt.outside, got)
+		}
+	}
+}
+
+func TestOverlayOpacity(t *testing.T) {
+	overlay := &Overlay{Name: "logo", Image: solidImage(10, 10, color.White), Position: PositionCenter, Opacity: 0.5}
+	src := solidImage(20, 20, color.Black)
+	dst := overlay.apply(src)
+
+	if got := dst.RGBAAt(10, 10); got.R < 120 || got.R > 135 || got.A != 255 {
+		t.Errorf("Expected half transparent watermark, got %v", got)
+	}
+
+	if src.RGBAAt(10, 10) != (color.RGBA{A: 255}) {
+		t.Error("Expected the source image to stay unchanged")
+	}
+}
+
+func TestOverlayLimitedToImage(t *testing.T) {
+	overlay := &Overlay{Name: "logo", Image: solidImage(100, 100, color.White), Opacity: 1, Margin: 2}
+	dst := overlay.apply(solidImage(20, 10, color.Black))
+
+	if got := dst.RGBAAt(1, 1); got != (color.RGBA{A: 255}) {
+		t.Errorf("Expected margin to stay uncovered, got %v", got)
+	}
+	if got := dst.RGBAAt(16, 5); got != (color.RGBA{R: 255, G: 255, B: 255, A: 255}) {
+		t.Errorf("Expected watermark scaled down into the image, got %v", got)
+	}
+}
+
+func TestOverlayText(t *testing.T) {
+	overlay := &Overlay{Name: "copyright", Text: "(c) shop", Position: PositionTopLeft, Opacity: 1}
+	dst := overlay.apply(solidImage(100, 30, color.Black))
+
+	var lit int
+	for y := 0; y < 13; y++ {
+		for x := 0; x < 56; x++ {
+			if dst.RGBAAt(x, y).R > 128 {
+				lit++
+			}
+		}
+	}
+
+	if lit == 0 {
+		t.Error("Expected text to be drawn")
+	}
+
+	if got := dst.RGBAAt(80, 20); got != (color.RGBA{A: 255}) {
+		t.Errorf("Expected no text outside its box, got %v", got)
+	}
+
+	if overlay.String() != "overlay:copyright" {
+		t.Errorf("Unexpected canonical form %q", overlay.String())
+	}
+}
@@ -43,13 +43,17 @@ func TestIntegrationBasic(t *testing.T) {
 		},
 		{
 			"Server Returns Error", "/300/300/nginx:8081/test_image_1.jpg",
-			http.StatusInternalServerError,
+			http.StatusBadGateway,
 		},
 		{"Image Returned", "/300/300/nginx/test_image_1.jpg", http.StatusOK},
 		{
 			"Image Smaller Than Required Size", "/1000/1000/nginx/test_image_1.jpg",
 			http.StatusOK,
 		},
+		{
+			"Image Smaller Than Required Size Without Enlarging", "/preview?url=nginx/test_image_1.jpg&w=1000&h=1000&enlarge=0",
+			http.StatusOK,
+		},
 	}
 
 	addr, err := getHostAddr()
@@ -0,0 +1,342 @@
+package http
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/heltirj/image_previewer/internal/app"
+	"github.com/heltirj/image_previewer/internal/imagetransformer"
+)
+
+var (
+	thumborSizeRe       = regexp.MustCompile(`^(-?\d*)x(-?\d*)$`)
+	thumborManualCropRe = regexp.MustCompile(`^\d+x\d+:\d+x\d+$`)
+	thumborFilterRe     = regexp.MustCompile(`(\w+)\(([^)]*)\)`)
+)
+
+var errNotCompat = errors.New("not a compatible url")
+
+// compatRouter serves Thumbor-style (/unsafe/300x200/smart/host/img.jpg) and imgproxy-style
+// (/insecure/rs:fill:300:200/plain/host/img.jpg) urls and hands everything else to next.
+// Signatures are not verified: thumbor urls must be unsafe, imgproxy ones may carry any.
+func (s *Server) compatRouter(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		segments := strings.Split(strings.TrimPrefix(r.URL.EscapedPath(), "/"), "/")
+
+		var (
+			opts app.Options
+			err  = errNotCompat
+		)
+
+		switch {
+		case s.compat.Thumbor && segments[0] == "unsafe":
+			opts, err = parseThumborPath(segments[1:])
+			if err == nil && r.URL.RawQuery != "" {
+				opts.Source += "?" + r.URL.RawQuery
+			}
+		case s.compat.Imgproxy && len(segments) > 2 && isImgproxyOption(segments[1]):
+			opts, err = parseImgproxyPath(segments[1:])
+		}
+
+		if errors.Is(err, errNotCompat) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if err != nil {
+			app.WriteError(w, r, &app.Error{Kind: app.KindBadRequest, Err: err})
+			return
+		}
+
+		s.app.ServeImage(w, r, opts)
+	})
+}
+
+// parseThumborPath parses /unsafe/[trim/][AxB:CxD/][fit-in/][WxH/][halign/][valign/][smart/]
+// [filters:.../]image. Manual crop, alignment and smart detection are accepted but the
+// image is always cropped around the center.
+func parseThumborPath(segments []string) (app.Options, error) {
+	opts := app.Options{Mode: imagetransformer.ModeFill}
+
+	for i, segment := range segments {
+		switch {
+		case segment == "trim" || strings.HasPrefix(segment, "trim:") || thumborManualCropRe.MatchString(segment):
+		case segment == "fit-in" || segment == "adaptive-fit-in" || segment == "full-fit-in":
+			opts.Mode = imagetransformer.ModeFit
+		case thumborSizeRe.MatchString(segment):
+			matches := thumborSizeRe.FindStringSubmatch(segment)
+			opts.Width = absAtoi(matches[1])
+			opts.Height = absAtoi(matches[2])
+
+			// Negative sizes mean flipping the image.
+			if strings.HasPrefix(matches[1], "-") {
+				opts.Operations = append(opts.Operations, imagetransformer.Flip("h"))
+			}
+			if strings.HasPrefix(matches[2], "-") {
+				opts.Operations = append(opts.Operations, imagetransformer.Flip("v"))
+			}
+		case segment == "left" || segment == "center" || segment == "right" ||
+			segment == "top" || segment == "middle" || segment == "bottom" || segment == "smart":
+		case strings.HasPrefix(segment, "filters:"):
+			filters, err := url.PathUnescape(segment)
+			if err != nil {
+				return app.Options{}, fmt.Errorf("invalid filters: %w", err)
+			}
+
+			if err := applyThumborFilters(&opts, filters); err != nil {
+				return app.Options{}, err
+			}
+		default:
+			source, err := url.PathUnescape(strings.Join(segments[i:], "/"))
+			if err != nil {
+				return app.Options{}, fmt.Errorf("invalid image url: %w", err)
+			}
+
+			opts.Source = source
+			return opts, nil
+		}
+	}
+
+	return app.Options{}, errors.New("image url is missing")
+}
+
+// applyThumborFilters applies the supported filters of filters:name(args):name(args)
+// and ignores the rest, like quality().
+func applyThumborFilters(opts *app.Options, filters string) error {
+	var ops []string
+	for _, matches := range thumborFilterRe.FindAllStringSubmatch(filters, -1) {
+		name, args := matches[1], strings.Split(matches[2], ",")
+
+		switch name {
+		case "format":
+			opts.Format = compatFormat(args[0])
+		case "no_upscale":
+			enlarge := false
+			opts.Enlarge = &enlarge
+		case "background_color":
+			opts.Background = args[0]
+		case "grayscale":
+			ops = append(ops, name)
+		case "brightness", "contrast":
+			ops = append(ops, name+":"+args[0])
+		case "blur":
+			// blur(radius[,sigma]), sigma defaults to the radius.
+			ops = append(ops, "blur:"+args[len(args)-1])
+		}
+	}
+
+	parsed, err := imagetransformer.ParseOperations(strings.Join(ops, ","))
+	if err != nil {
+		return fmt.Errorf("invalid filters: %w", err)
+	}
+	opts.Operations = append(opts.Operations, parsed...)
+
+	return nil
+}
+
+// parseImgproxyPath parses /signature/option:args/.../plain/source[@ext] and
+// /signature/option:args/.../base64source[.ext].
+func parseImgproxyPath(segments []string) (app.Options, error) {
+	opts := app.Options{Mode: imagetransformer.ModeFit}
+
+	i := 0
+	for ; i < len(segments) && segments[i] != "plain" && strings.Contains(segments[i], ":"); i++ {
+		if err := applyImgproxyOption(&opts, strings.Split(segments[i], ":")); err != nil {
+			return app.Options{}, err
+		}
+	}
+
+	if i == len(segments) {
+		return app.Options{}, errors.New("image url is missing")
+	}
+
+	if segments[i] == "plain" {
+		source, err := url.PathUnescape(strings.Join(segments[i+1:], "/"))
+		if err != nil {
+			return app.Options{}, fmt.Errorf("invalid image url: %w", err)
+		}
+
+		// An "@" followed by a path is part of the source, not the format suffix.
+		if at := strings.LastIndex(source, "@"); at >= 0 && !strings.Contains(source[at+1:], "/") {
+			opts.Format = compatFormat(source[at+1:])
+			source = source[:at]
+		}
+
+		opts.Source = source
+		return opts, nil
+	}
+
+	encoded := strings.Join(segments[i:], "")
+	if ext := path.Ext(encoded); ext != "" {
+		opts.Format = compatFormat(ext[1:])
+		encoded = strings.TrimSuffix(encoded, ext)
+	}
+
+	source, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(encoded, "="))
+	if err != nil {
+		return app.Options{}, fmt.Errorf("invalid encoded image url: %w", err)
+	}
+
+	opts.Source = string(source)
+	return opts, nil
+}
+
+func applyImgproxyOption(opts *app.Options, args []string) error {
+	name, args := args[0], args[1:]
+
+	var err error
+	switch name {
+	case "resize", "rs":
+		if len(args) > 0 && args[0] != "" {
+			opts.Mode = imgproxyResizingType(args[0])
+		}
+		if len(args) > 1 {
+			err = errors.Join(setImgproxySize(&opts.Width, args[1]), setImgproxySize(&opts.Height, args[2:]...))
+		}
+		if len(args) > 3 && args[3] != "" {
+			opts.Enlarge = imgproxyBool(args[3])
+		}
+	case "size", "s":
+		if len(args) > 0 {
+			err = errors.Join(setImgproxySize(&opts.Width, args[0]), setImgproxySize(&opts.Height, args[1:]...))
+		}
+		if len(args) > 2 && args[2] != "" {
+			opts.Enlarge = imgproxyBool(args[2])
+		}
+	case "resizing_type", "rt":
+		if len(args) > 0 {
+			opts.Mode = imgproxyResizingType(args[0])
+		}
+	case "enlarge", "el":
+		if len(args) > 0 {
+			opts.Enlarge = imgproxyBool(args[0])
+		}
+	case "dpr":
+		if len(args) > 0 {
+			opts.DPR, err = strconv.ParseFloat(args[0], 64)
+		}
+	case "background", "bg":
+		err = setImgproxyBackground(opts, args)
+	case "rotate", "rot", "blur", "bl", "sharpen", "sh":
+		err = appendImgproxyOperation(opts, name, args)
+	case "width", "w":
+		err = setImgproxySize(&opts.Width, args...)
+	case "height", "h":
+		err = setImgproxySize(&opts.Height, args...)
+	case "format", "f", "ext":
+		if len(args) > 0 {
+			opts.Format = compatFormat(args[0])
+		}
+	}
+
+	if err != nil {
+		return fmt.Errorf("invalid %s option: %w", name, err)
+	}
+
+	return nil
+}
+
+func appendImgproxyOperation(opts *app.Options, name string, args []string) error {
+	if len(args) == 0 {
+		return errors.New("argument is missing")
+	}
+
+	// imgproxy treats zero as no operation.
+	if args[0] == "0" {
+		return nil
+	}
+
+	names := map[string]string{"rot": "rotate", "bl": "blur", "sh": "sharpen"}
+	if full, ok := names[name]; ok {
+		name = full
+	}
+
+	ops, err := imagetransformer.ParseOperations(name + ":" + args[0])
+	if err != nil {
+		return err
+	}
+	opts.Operations = append(opts.Operations, ops...)
+
+	return nil
+}
+
+// setImgproxyBackground accepts both the hex (bg:ffffff) and the R:G:B (bg:255:255:255)
+// forms.
+func setImgproxyBackground(opts *app.Options, args []string) error {
+	switch len(args) {
+	case 1:
+		opts.Background = args[0]
+	case 3:
+		var rgb [3]uint64
+		for i, arg := range args {
+			value, err := strconv.ParseUint(arg, 10, 8)
+			if err != nil {
+				return err
+			}
+			rgb[i] = value
+		}
+		opts.Background = fmt.Sprintf("%02x%02x%02x", rgb[0], rgb[1], rgb[2])
+	default:
+		return errors.New("expected hex or R:G:B color")
+	}
+
+	return nil
+}
+
+func setImgproxySize(dst *int, args ...string) error {
+	if len(args) == 0 || args[0] == "" {
+		return nil
+	}
+
+	n, err := strconv.Atoi(args[0])
+	if err != nil {
+		return err
+	}
+
+	*dst = n
+	return nil
+}
+
+func imgproxyResizingType(resizingType string) imagetransformer.Mode {
+	switch resizingType {
+	case "fit":
+		return imagetransformer.ModeFit
+	case "force":
+		return imagetransformer.ModeStretch
+	default:
+		return imagetransformer.ModeFill
+	}
+}
+
+func imgproxyBool(arg string) *bool {
+	enabled := arg == "1" || arg == "t" || arg == "true"
+	return &enabled
+}
+
+func isImgproxyOption(segment string) bool {
+	return segment == "plain" || strings.Contains(segment, ":")
+}
+
+func compatFormat(format string) app.Format {
+	if format == "jpg" {
+		return app.FormatJPEG
+	}
+
+	return app.Format(format)
+}
+
+func absAtoi(s string) int {
+	n, _ := strconv.Atoi(s)
+	if n < 0 {
+		return -n
+	}
+
+	return n
+}
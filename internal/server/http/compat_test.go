@@ -0,0 +1,261 @@
+package http
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/heltirj/image_previewer/internal/app"
+	"github.com/heltirj/image_previewer/internal/config"
+	"github.com/heltirj/image_previewer/internal/imagetransformer"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeApp struct {
+	opts     *app.Options
+	fellBack bool
+}
+
+func (f *fakeApp) GetResizedImage(http.ResponseWriter, *http.Request) { f.fellBack = true }
+func (f *fakeApp) GetPreview(http.ResponseWriter, *http.Request)      {}
+func (f *fakeApp) ClearCache(http.ResponseWriter, *http.Request)      {}
+func (f *fakeApp) Status(http.ResponseWriter, *http.Request)          {}
+func (f *fakeApp) Warmup(http.ResponseWriter, *http.Request)          {}
+func (f *fakeApp) WarmupStatus(http.ResponseWriter, *http.Request)    {}
+
+func (f *fakeApp) ServeImage(_ http.ResponseWriter, _ *http.Request, opts app.Options) {
+	f.opts = &opts
+}
+
+func TestParseThumborPath(t *testing.T) {
+	disabled := false
+
+	tests := []struct {
+		path     string
+		expected app.Options
+	}{
+		{
+			"300x200/smart/example.com/img.jpg",
+			app.Options{Width: 300, Height: 200, Mode: imagetransformer.ModeFill, Source: "example.com/img.jpg"},
+		},
+		{
+			"trim/10x20:100x200/fit-in/-300x200/left/top/http://example.com/a/b.jpg",
+			app.Options{
+				Width: 300, Height: 200, Mode: imagetransformer.ModeFit, Source: "http://example.com/a/b.jpg",
+				Operations: imagetransformer.Operations{imagetransformer.Flip("h")},
+			},
+		},
+		{
+			"300x200/filters:grayscale():blur(3,1.5):brightness(10):quality(80)/example.com/img.jpg",
+			app.Options{
+				Width: 300, Height: 200, Mode: imagetransformer.ModeFill, Source: "example.com/img.jpg",
+				Operations: imagetransformer.Operations{
+					imagetransformer.Grayscale{}, imagetransformer.Blur(1.5), imagetransformer.Brightness(10),
+				},
+			},
+		},
+		{
+			"300x200/filters:quality(80):format(png)/example.com/img.jpg",
+			app.Options{
+				Width: 300, Height: 200, Mode: imagetransformer.ModeFill,
+				Format: app.FormatPNG, Source: "example.com/img.jpg",
+			},
+		},
+		{
+			"300x200/filters:no_upscale()/example.com/img.jpg",
+			app.Options{
+				Width: 300, Height: 200, Mode: imagetransformer.ModeFill,
+				Source: "example.com/img.jpg", Enlarge: &disabled,
+			},
+		},
+		{
+			"300x200/filters:background_color(ff0000)/example.com/img.png",
+			app.Options{
+				Width: 300, Height: 200, Mode: imagetransformer.ModeFill,
+				Source: "example.com/img.png", Background: "ff0000",
+			},
+		},
+		{
+			"300x200/example.com%2Fimg%20name.jpg",
+			app.Options{Width: 300, Height: 200, Mode: imagetransformer.ModeFill, Source: "example.com/img name.jpg"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			opts, err := parseThumborPath(strings.Split(tt.path, "/"))
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, opts)
+		})
+	}
+
+	t.Run("missing image", func(t *testing.T) {
+		_, err := parseThumborPath([]string{"300x200", "smart"})
+		require.Error(t, err)
+	})
+
+	t.Run("invalid filter", func(t *testing.T) {
+		_, err := parseThumborPath([]string{"300x200", "filters:brightness(500)", "example.com", "img.jpg"})
+		require.Error(t, err)
+	})
+}
+
+func TestParseImgproxyPath(t *testing.T) {
+	encoded := base64.RawURLEncoding.EncodeToString([]byte("http://example.com/img.jpg?v=1"))
+	enabled, disabled := true, false
+
+	tests := []struct {
+		path     string
+		expected app.Options
+	}{
+		{
+			"rs:fill:300:200/plain/example.com/img.jpg",
+			app.Options{Width: 300, Height: 200, Mode: imagetransformer.ModeFill, Source: "example.com/img.jpg"},
+		},
+		{
+			"s:300:200/rt:force/plain/http://example.com/img.jpg@png",
+			app.Options{
+				Width: 300, Height: 200, Mode: imagetransformer.ModeStretch,
+				Format: app.FormatPNG, Source: "http://example.com/img.jpg",
+			},
+		},
+		{
+			"rs:fill:300:200/plain/example.com/@user/a.jpg",
+			app.Options{Width: 300, Height: 200, Mode: imagetransformer.ModeFill, Source: "example.com/@user/a.jpg"},
+		},
+		{
+			"rs:fill:300:200/plain/example.com/@user/a.jpg@png",
+			app.Options{
+				Width: 300, Height: 200, Mode: imagetransformer.ModeFill,
+				Format: app.FormatPNG, Source: "example.com/@user/a.jpg",
+			},
+		},
+		{
+			"rs:fill:300:200:1/plain/example.com/img.jpg",
+			app.Options{
+				Width: 300, Height: 200, Mode: imagetransformer.ModeFill,
+				Source: "example.com/img.jpg", Enlarge: &enabled,
+			},
+		},
+		{
+			"s:300:200/el:0/dpr:2/plain/example.com/img.jpg",
+			app.Options{
+				Width: 300, Height: 200, Mode: imagetransformer.ModeFit,
+				Source: "example.com/img.jpg", Enlarge: &disabled, DPR: 2,
+			},
+		},
+		{
+			"rs:fill:300:200/bg:255:0:128/plain/example.com/img.png",
+			app.Options{
+				Width: 300, Height: 200, Mode: imagetransformer.ModeFill,
+				Source: "example.com/img.png", Background: "ff0080",
+			},
+		},
+		{
+			"rs:fill:300:200/bg:00ff00/plain/example.com/img.png",
+			app.Options{
+				Width: 300, Height: 200, Mode: imagetransformer.ModeFill,
+				Source: "example.com/img.png", Background: "00ff00",
+			},
+		},
+		{
+			"rs:fill:300:200/rot:90/bl:0/sh:1.5/plain/example.com/img.jpg",
+			app.Options{
+				Width: 300, Height: 200, Mode: imagetransformer.ModeFill, Source: "example.com/img.jpg",
+				Operations: imagetransformer.Operations{imagetransformer.Rotate(90), imagetransformer.Sharpen(1.5)},
+			},
+		},
+		{
+			"w:300/h:200/plain/example.com%2Fimg.jpg",
+			app.Options{Width: 300, Height: 200, Mode: imagetransformer.ModeFit, Source: "example.com/img.jpg"},
+		},
+		{
+			"rs:fit:300:200/f:jpg/" + encoded[:10] + "/" + encoded[10:] + ".gif",
+			app.Options{
+				Width: 300, Height: 200, Mode: imagetransformer.ModeFit,
+				Format: app.FormatGIF, Source: "http://example.com/img.jpg?v=1",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			opts, err := parseImgproxyPath(strings.Split(tt.path, "/"))
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, opts)
+		})
+	}
+
+	for _, path := range []string{
+		"rs:fill:abc:200/plain/example.com/img.jpg",
+		"dpr:x/plain/example.com/img.jpg",
+		"bg:256:0:0/plain/example.com/img.jpg",
+		"rot:45/plain/example.com/img.jpg",
+		"rs:fill:300:200",
+		"rs:fill:300:200/%%%",
+	} {
+		t.Run(path, func(t *testing.T) {
+			_, err := parseImgproxyPath(strings.Split(path, "/"))
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestCompatRouter(t *testing.T) {
+	tests := []struct {
+		name           string
+		compat         config.CompatConfig
+		path           string
+		expectedSource string
+		expectedStatus int
+	}{
+		{
+			"thumbor", config.CompatConfig{Thumbor: true},
+			"/unsafe/300x200/example.com/img.jpg?v=1", "example.com/img.jpg?v=1", http.StatusOK,
+		},
+		{
+			"imgproxy", config.CompatConfig{Imgproxy: true},
+			"/insecure/rs:fill:300:200/plain/example.com/img.jpg", "example.com/img.jpg", http.StatusOK,
+		},
+		{
+			"thumbor disabled", config.CompatConfig{Imgproxy: true},
+			"/unsafe/300x200/example.com/img.jpg", "", http.StatusOK,
+		},
+		{
+			"imgproxy disabled", config.CompatConfig{Thumbor: true},
+			"/insecure/rs:fill:300:200/plain/example.com/img.jpg", "", http.StatusOK,
+		},
+		{
+			"legacy route", config.CompatConfig{Thumbor: true, Imgproxy: true},
+			"/300/200/http://example.com/img.jpg", "", http.StatusOK,
+		},
+		{
+			"invalid options", config.CompatConfig{Imgproxy: true},
+			"/insecure/w:abc/plain/example.com/img.jpg", "", http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeApp{}
+			s := &Server{app: fake, compat: tt.compat}
+
+			w := httptest.NewRecorder()
+			router := s.compatRouter(http.HandlerFunc(fake.GetResizedImage))
+			router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.path, nil))
+
+			require.Equal(t, tt.expectedStatus, w.Code)
+			if tt.expectedSource == "" {
+				require.Nil(t, fake.opts)
+				require.Equal(t, tt.expectedStatus == http.StatusOK, fake.fellBack)
+				return
+			}
+
+			require.NotNil(t, fake.opts)
+			require.Equal(t, tt.expectedSource, fake.opts.Source)
+			require.False(t, fake.fellBack)
+		})
+	}
+}
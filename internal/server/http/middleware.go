@@ -1,20 +1,77 @@
 package http
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"net/http"
+	"regexp"
+	"runtime/debug"
 	"time"
+
+	"github.com/heltirj/image_previewer/internal/app"
 )
 
+var requestIDRe = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// requestIDMiddleware makes sure every request carries an X-Request-Id, keeping a
+// well-formed one sent by the client, and echoes it in the response.
+func (s *Server) requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get(app.RequestIDHeader)
+		if !requestIDRe.MatchString(requestID) {
+			requestID = newRequestID()
+			r.Header.Set(app.RequestIDHeader, requestID)
+		}
+
+		w.Header().Set(app.RequestIDHeader, requestID)
+		next.ServeHTTP(w, r)
+	})
+}
+
+func newRequestID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+
+	return hex.EncodeToString(id)
+}
+
+// recoveryMiddleware turns a panic of the handler into a logged 500 instead of a dropped
+// connection. http.ErrAbortHandler keeps aborting the response.
+func (s *Server) recoveryMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			recovered := recover()
+			if recovered == nil {
+				return
+			}
+
+			if err, ok := recovered.(error); ok && errors.Is(err, http.ErrAbortHandler) {
+				panic(recovered)
+			}
+
+			s.logger.ErrorKV("handler panicked", "panic", recovered, "method", r.Method, "path", r.URL.Path,
+				"requestId", r.Header.Get(app.RequestIDHeader), "stack", string(debug.Stack()))
+			app.WriteError(w, r, errors.New("internal server error"))
+		}()
+
+		next.ServeHTTP(w, r)
+	})
+}
+
 func (s *Server) loggingMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
 		ip := r.RemoteAddr
 		userAgent := r.UserAgent()
+		requestID := r.Header.Get(app.RequestIDHeader)
 
 		rw := &responseWriter{ResponseWriter: w}
 		next.ServeHTTP(rw, r)
 
-		w.WriteHeader(rw.statusCode)
+		if rw.statusCode == 0 {
+			rw.statusCode = http.StatusOK
+		}
 
 		latency := time.Since(start)
 
@@ -23,11 +80,12 @@ func (s *Server) loggingMiddleware(next http.Handler) http.Handler {
 				r.URL.Path, "httpVersion", r.Proto, "statusCode", rw.statusCode, "headers", rw.Header(), "latency",
 				latency,
 				"userAgent",
-				userAgent)
+				userAgent, "requestId", requestID)
 			return
 		}
 
 		s.logger.InfoKV("handled request", "ip", ip, "time", time.Now(), "method", r.Method, "path", r.URL.Path,
-			"httpVersion", r.Proto, "statusCode", rw.statusCode, "latency", latency, "userAgent", userAgent)
+			"httpVersion", r.Proto, "statusCode", rw.statusCode, "latency", latency, "userAgent", userAgent,
+			"requestId", requestID)
 	})
 }
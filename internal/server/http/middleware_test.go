@@ -0,0 +1,129 @@
+package http
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/heltirj/image_previewer/internal/app"
+	"github.com/heltirj/image_previewer/internal/logger"
+	"github.com/stretchr/testify/require"
+)
+
+type countingWriter struct {
+	*httptest.ResponseRecorder
+	writeHeaderCalls int
+}
+
+func (cw *countingWriter) WriteHeader(code int) {
+	cw.writeHeaderCalls++
+	cw.ResponseRecorder.WriteHeader(code)
+}
+
+func TestLoggingMiddleware(t *testing.T) {
+	s := &Server{logger: logger.New(logger.LogLevelError)}
+
+	tests := []struct {
+		name           string
+		handler        http.HandlerFunc
+		expectedStatus int
+	}{
+		{
+			"explicit status",
+			func(w http.ResponseWriter, _ *http.Request) {
+				http.Error(w, "not found", http.StatusNotFound)
+			},
+			http.StatusNotFound,
+		},
+		{
+			"implicit status",
+			func(w http.ResponseWriter, _ *http.Request) {
+				w.Write([]byte("ok"))
+			},
+			http.StatusOK,
+		},
+		{
+			"repeated status",
+			func(w http.ResponseWriter, _ *http.Request) {
+				w.WriteHeader(http.StatusBadGateway)
+				w.WriteHeader(http.StatusInternalServerError)
+			},
+			http.StatusBadGateway,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := &countingWriter{ResponseRecorder: httptest.NewRecorder()}
+			s.loggingMiddleware(tt.handler).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+
+			require.Equal(t, tt.expectedStatus, w.Code)
+			require.Equal(t, 1, w.writeHeaderCalls)
+		})
+	}
+}
+
+func TestRequestIDMiddleware(t *testing.T) {
+	s := &Server{logger: logger.New(logger.LogLevelError)}
+
+	var seen string
+	handler := s.requestIDMiddleware(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		seen = r.Header.Get(app.RequestIDHeader)
+	}))
+
+	t.Run("generated", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+
+		require.Len(t, seen, 32)
+		require.Equal(t, seen, rec.Header().Get(app.RequestIDHeader))
+	})
+
+	t.Run("kept from client", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set(app.RequestIDHeader, "client-id.1")
+
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		require.Equal(t, "client-id.1", seen)
+		require.Equal(t, "client-id.1", rec.Header().Get(app.RequestIDHeader))
+	})
+
+	t.Run("malformed replaced", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set(app.RequestIDHeader, "bad id\twith spaces")
+
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		require.Len(t, seen, 32)
+		require.Equal(t, seen, rec.Header().Get(app.RequestIDHeader))
+	})
+}
+
+func TestRecoveryMiddleware(t *testing.T) {
+	s := &Server{logger: logger.New(logger.LogLevelError)}
+	handler := s.withMiddlewares(func(_ http.ResponseWriter, _ *http.Request) {
+		panic("unexpected image type")
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Accept", "application/json")
+
+	rec := httptest.NewRecorder()
+	require.NotPanics(t, func() { handler.ServeHTTP(rec, req) })
+	require.Equal(t, http.StatusInternalServerError, rec.Code)
+	require.Contains(t, rec.Body.String(), `"code":"INTERNAL_ERROR"`)
+	require.NotEmpty(t, rec.Header().Get(app.RequestIDHeader))
+
+	t.Run("abort", func(t *testing.T) {
+		handler := s.recoveryMiddleware(http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {
+			panic(http.ErrAbortHandler)
+		}))
+
+		require.PanicsWithValue(t, http.ErrAbortHandler, func() {
+			handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+		})
+	})
+}
@@ -5,12 +5,16 @@ import (
 	"fmt"
 	"net/http"
 	"time"
+
+	"github.com/heltirj/image_previewer/internal/app"
+	"github.com/heltirj/image_previewer/internal/config"
 )
 
 type Server struct {
 	server *http.Server
 	logger Logger
 	app    Application
+	compat config.CompatConfig
 }
 
 type Logger interface {
@@ -26,13 +30,19 @@ type Logger interface {
 
 type Application interface {
 	GetResizedImage(w http.ResponseWriter, r *http.Request)
+	GetPreview(w http.ResponseWriter, r *http.Request)
+	ServeImage(w http.ResponseWriter, r *http.Request, opts app.Options)
 	ClearCache(w http.ResponseWriter, r *http.Request)
+	Status(w http.ResponseWriter, r *http.Request)
+	Warmup(w http.ResponseWriter, r *http.Request)
+	WarmupStatus(w http.ResponseWriter, r *http.Request)
 }
 
-func NewServer(logger Logger, app Application, port int) *Server {
+func NewServer(logger Logger, application Application, port int, compat config.CompatConfig) *Server {
 	srv := &Server{
 		logger: logger,
-		app:    app,
+		app:    application,
+		compat: compat,
 	}
 
 	srv.server = &http.Server{
@@ -66,11 +76,19 @@ func (s *Server) Stop(ctx context.Context) error {
 
 func (s *Server) setupRoutes() http.Handler {
 	mux := http.NewServeMux()
-	mux.Handle("/", s.loggingMiddleware(http.HandlerFunc(s.app.GetResizedImage)))
-	mux.Handle("/clear", s.loggingMiddleware(http.HandlerFunc(s.app.ClearCache)))
+	mux.Handle("/", s.withMiddlewares(s.compatRouter(http.HandlerFunc(s.app.GetResizedImage)).ServeHTTP))
+	mux.Handle("/preview", s.withMiddlewares(s.app.GetPreview))
+	mux.Handle("/clear", s.withMiddlewares(s.app.ClearCache))
+	mux.Handle("/status", s.withMiddlewares(s.app.Status))
+	mux.Handle("POST /warmup", s.withMiddlewares(s.app.Warmup))
+	mux.Handle("GET /warmup/{id}", s.withMiddlewares(s.app.WarmupStatus))
 	return mux
 }
 
+func (s *Server) withMiddlewares(handler http.HandlerFunc) http.Handler {
+	return s.requestIDMiddleware(s.loggingMiddleware(s.recoveryMiddleware(handler)))
+}
+
 type responseWriter struct {
 	http.ResponseWriter
 	statusCode int
@@ -78,11 +96,19 @@ type responseWriter struct {
 }
 
 func (rw *responseWriter) WriteHeader(code int) {
+	if rw.statusCode != 0 {
+		return
+	}
+
 	rw.statusCode = code
 	rw.ResponseWriter.WriteHeader(code)
 }
 
 func (rw *responseWriter) Write(b []byte) (int, error) {
+	if rw.statusCode == 0 {
+		rw.WriteHeader(http.StatusOK)
+	}
+
 	rw.body = b
 	return rw.ResponseWriter.Write(b)
 }